@@ -12,6 +12,10 @@ type Config struct {
 	DefaultOut []string                  `yaml:"default_out"`
 	Out        map[string]map[string]any `yaml:"out"`
 	Mappings   []map[string]any          `yaml:"mappings"`
+	MaxWorkers int                       `yaml:"max_workers"` // Partitions fetched concurrently across indices during a full reindex
+	MaxIndices int                       `yaml:"max_indices"` // Indices reindexed concurrently, 0 for all
+
+	MaxRowsPerSecond int `yaml:"max_rows_per_second"` // Full reindex rate shared by every index, 0 for unlimited
 }
 
 func (config *Config) LoadFromYaml(path string) error {
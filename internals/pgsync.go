@@ -1,11 +1,17 @@
 package internals
 
 import (
+	"errors"
 	"fmt"
 	"github.com/quix-labs/pg-el-sync/internals/types"
 	"github.com/quix-labs/pg-el-sync/internals/utils"
 	"github.com/quix-labs/pg-el-sync/publishers/elastic"
 	"github.com/quix-labs/pg-el-sync/subscribers/postgresql"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,6 +21,17 @@ type PgSync struct {
 	publishers   map[string]types.AbstractPublisher
 	indices      map[string]*types.Index
 	eventChannel chan *interface{}
+
+	bufferLock     sync.Mutex
+	buffering      map[string]int // Reindexes per index holding its live events until they finished
+	bufferedEvents []*interface{}
+
+	workers       *utils.Semaphore // Partitions fetched at once by every reindex, max_workers
+	reindexing    *utils.Semaphore // Indices reindexed at once, max_indices
+	reindexLocks  map[string]*sync.Mutex
+	catchUpLock   sync.Mutex
+	catchUps      map[string]bool // Catch-up waiting or running per index
+	catchUpsAgain map[string]bool // Catch-up requested while running, run again once finished
 }
 
 func (pgSync *PgSync) Init(config *Config) error {
@@ -32,6 +49,7 @@ func (pgSync *PgSync) Init(config *Config) error {
 		return err
 	}
 	pgSync.eventChannel = make(chan *interface{}, 100)
+	pgSync.initReindexLimits()
 	err = pgSync.initSubscribers()
 	if err != nil {
 		return err
@@ -43,6 +61,12 @@ func (pgSync *PgSync) Init(config *Config) error {
 	return nil
 }
 
+func (pgSync *PgSync) Install() {
+	for _, subscriber := range pgSync.GetSubscribers() {
+		subscriber.Install()
+	}
+}
+
 func (pgSync *PgSync) Terminate() {
 	for _, index := range pgSync.indices {
 		index.Terminate()
@@ -62,44 +86,174 @@ func (pgSync *PgSync) Start() {
 	}
 
 	for true {
-		notification := <-pgSync.eventChannel
+		pgSync.handleEvent(<-pgSync.eventChannel)
+	}
+}
 
-		switch event := (*notification).(type) {
-		case types.DeleteEvent:
-			if event.Reference != "" {
-				pgSync.indices[event.Index].WaitingEvents.Delete.Append(&event)
-			}
-		case types.InsertEvent:
-			if event.Reference != "" {
-				pgSync.indices[event.Index].WaitingEvents.Insert.Append(&event)
-			}
-		case types.UpdateEvent:
-			if event.Reference == "" {
-				continue
-			}
-			index := pgSync.indices[event.Index]
-			/**----SOFT DELETE------*/
-			if event.SoftDeleted && !event.PreviouslySoftDeleted {
-				index.WaitingEvents.Delete.Append(&types.DeleteEvent{
-					Index:     event.Index,
-					Reference: event.Reference,
-				})
-				continue
-			}
-			if !event.SoftDeleted && event.PreviouslySoftDeleted {
-				index.WaitingEvents.Insert.Append(&types.InsertEvent{
-					Index:     event.Index,
-					Reference: event.Reference,
-				})
-				continue
-			}
-			index.WaitingEvents.Update.Append(&event)
+// StartWithReindex listen while reindexing, live events are replayed once the bulk load finished
+func (pgSync *PgSync) StartWithReindex() error {
+	var indices []string
+	for name := range pgSync.indices {
+		indices = append(indices, name)
+	}
+	pgSync.setBuffering(indices, true)
+	go pgSync.Start()
 
-		case types.RelationUpdateEvent:
-			if event.Reference != "" {
-				pgSync.indices[event.Index].WaitingEvents.RelationsUpdate.Append(&event)
+	var releases []func()
+	for name, subscriber := range pgSync.GetSubscribers() {
+		release, err := subscriber.ExportSnapshot()
+		if err != nil {
+			for _, release := range releases {
+				release()
 			}
+			return fmt.Errorf("unable to export snapshot for subscriber %s: %w", name, err)
+		}
+		releases = append(releases, release)
+	}
+	err := pgSync.FullReindex(false)
+	if err != nil {
+		fmt.Printf("Snapshot reindex failed, documents may be missing until the next reindex: %s\n", err)
+	}
+	for _, release := range releases {
+		release()
+	}
+
+	pgSync.setBuffering(indices, false)
+	return nil
+}
+
+func (pgSync *PgSync) handleEvent(notification *interface{}) {
+	pgSync.bufferLock.Lock()
+	defer pgSync.bufferLock.Unlock()
+	if index := getEventIndex(notification); index != "" && pgSync.buffering[index] > 0 {
+		pgSync.bufferedEvents = append(pgSync.bufferedEvents, notification)
+		return
+	}
+	pgSync.routeEvent(notification)
+}
+
+func (pgSync *PgSync) setBuffering(indices []string, buffering bool) {
+	pgSync.bufferLock.Lock()
+	defer pgSync.bufferLock.Unlock()
+	for _, index := range indices {
+		if buffering {
+			pgSync.buffering[index]++
+		} else {
+			pgSync.buffering[index]--
+		}
+	}
+	if buffering {
+		return
+	}
+
+	var held []*interface{}
+	replayed := 0
+	for _, notification := range pgSync.bufferedEvents {
+		if pgSync.buffering[getEventIndex(notification)] > 0 {
+			held = append(held, notification)
+			continue
+		}
+		pgSync.routeEvent(notification)
+		replayed++
+	}
+	pgSync.bufferedEvents = held
+	fmt.Printf("Replayed %d events received during reindex\n", replayed)
+}
+
+func getEventIndex(notification *interface{}) string {
+	switch event := (*notification).(type) {
+	case types.InsertEvent:
+		return event.Index
+	case types.UpdateEvent:
+		return event.Index
+	case types.DeleteEvent:
+		return event.Index
+	case types.RelationUpdateEvent:
+		return event.Index
+	}
+	return ""
+}
+
+func (pgSync *PgSync) routeEvent(notification *interface{}) {
+	switch event := (*notification).(type) {
+	case types.DeleteEvent:
+		if event.Reference == "" {
+			event.Acknowledge()
+			return
+		}
+		pgSync.indices[event.Index].WaitingEvents.Delete.Append(&event)
+	case types.InsertEvent:
+		if event.Reference == "" {
+			event.Acknowledge()
+			return
+		}
+		pgSync.indices[event.Index].WaitingEvents.Insert.Append(&event)
+	case types.UpdateEvent:
+		if event.Reference == "" {
+			event.Acknowledge()
+			return
+		}
+		index := pgSync.indices[event.Index]
+		/**----SOFT DELETE------*/
+		if event.SoftDeleted && !event.PreviouslySoftDeleted {
+			index.WaitingEvents.Delete.Append(&types.DeleteEvent{
+				Acknowledgement: event.Acknowledgement,
+				Index:           event.Index,
+				Reference:       event.Reference,
+			})
+			return
+		}
+		if !event.SoftDeleted && event.PreviouslySoftDeleted {
+			index.WaitingEvents.Insert.Append(&types.InsertEvent{
+				Acknowledgement: event.Acknowledgement,
+				Index:           event.Index,
+				Reference:       event.Reference,
+			})
+			return
+		}
+		index.WaitingEvents.Update.Append(&event)
+
+	case types.RelationUpdateEvent:
+		if event.Reference == "" {
+			event.Acknowledge()
+			return
+		}
+		pgSync.indices[event.Index].WaitingEvents.RelationsUpdate.Append(&event)
+	case types.ReindexEvent:
+		pgSync.requestCatchUp(pgSync.indices[event.Index])
+	}
+}
+
+// requestCatchUp merge requests received while a catch-up is running into a single next run
+func (pgSync *PgSync) requestCatchUp(index *types.Index) {
+	pgSync.catchUpLock.Lock()
+	defer pgSync.catchUpLock.Unlock()
+	if pgSync.catchUps[index.Name] {
+		pgSync.catchUpsAgain[index.Name] = true
+		return
+	}
+	pgSync.catchUps[index.Name] = true
+	go pgSync.catchUp(index)
+}
+
+func (pgSync *PgSync) catchUp(index *types.Index) {
+	for {
+		start := time.Now()
+		err := pgSync.reindex(index, types.ReindexCatchUp)
+		if err != nil {
+			fmt.Printf("Catch-up indexing %s failed after %s: %s\n", index.Name, time.Since(start).String(), err)
+		} else {
+			fmt.Printf("Catch-up indexing %s finished in %s!\n", index.Name, time.Since(start).String())
 		}
+
+		pgSync.catchUpLock.Lock()
+		if !pgSync.catchUpsAgain[index.Name] {
+			delete(pgSync.catchUps, index.Name)
+			pgSync.catchUpLock.Unlock()
+			return
+		}
+		delete(pgSync.catchUpsAgain, index.Name)
+		pgSync.catchUpLock.Unlock()
 	}
 }
 
@@ -126,33 +280,137 @@ func (pgSync *PgSync) GetPublisher(name string) (types.AbstractPublisher, error)
 	}
 	return publisher, nil
 }
-func (pgSync *PgSync) FullReindex() {
+
+func (pgSync *PgSync) FullReindex(resume bool) error {
 	i := len(pgSync.indices)
-	finishedChan := make(chan *types.Index)
+	type result struct {
+		index *types.Index
+		err   error
+	}
+	finishedChan := make(chan result)
+	mode := types.ReindexFull
+	if resume {
+		mode = types.ReindexResume
+	}
 
 	start := time.Now()
 	for _, index := range pgSync.indices {
 		index := index
 		go func() {
-			index.IndexAllDocuments()
-			finishedChan <- index
+			finishedChan <- result{index: index, err: pgSync.reindex(index, mode)}
 		}()
 	}
+	var errs []error
 	for i > 0 {
-		idx := <-finishedChan
+		finished := <-finishedChan
 		i--
 		end := time.Since(start).String()
-		fmt.Printf("Indexing %s finished in %s!\n", idx.Name, end)
+		if finished.err != nil {
+			fmt.Printf("Indexing %s failed in %s: %s\n", finished.index.Name, end, finished.err)
+			errs = append(errs, fmt.Errorf("%s: %w", finished.index.Name, finished.err))
+			continue
+		}
+		fmt.Printf("Indexing %s finished in %s!\n", finished.index.Name, end)
+	}
+	return errors.Join(errs...)
+}
+
+func (pgSync *PgSync) reindex(index *types.Index, mode types.ReindexMode) error {
+	lock := pgSync.reindexLocks[index.Name]
+	lock.Lock()
+	defer lock.Unlock()
+
+	pgSync.reindexing.Acquire(1)
+	defer pgSync.reindexing.Release(1)
+	held := pgSync.workers.Acquire(index.Workers)
+	defer pgSync.workers.Release(held)
+
+	if mode == types.ReindexCatchUp {
+		pgSync.setBuffering([]string{index.Name}, true)
+		defer pgSync.setBuffering([]string{index.Name}, false)
+	}
+	return index.IndexAllDocuments(held, mode)
+}
+
+func (pgSync *PgSync) Teardown(dryRun bool) error {
+	for _, subscriber := range pgSync.GetSubscribers() {
+		err := subscriber.Teardown(pgSync.getIndicesForSubscriber(subscriber), dryRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportMigration write a versioned SQL migration per subscriber, statements that cannot run
+// in a transaction go to a following migration
+func (pgSync *PgSync) ExportMigration(directory string) error {
+	version := time.Now().UTC().Format("20060102150405")
+	for name, subscriber := range pgSync.GetSubscribers() {
+		indices := pgSync.getIndicesForSubscriber(subscriber)
+		err := writeMigration(filepath.Join(directory, fmt.Sprintf("V%s__pgsync_%s.sql", version, name)), name, subscriber.GetInstallStatements(indices))
+		if err != nil {
+			return err
+		}
+
+		statements := subscriber.GetNonTransactionalStatements(indices)
+		if len(statements) == 0 {
+			continue
+		}
+		file := filepath.Join(directory, fmt.Sprintf("V%s.1__pgsync_%s_non_transactional.sql", version, name))
+		err = writeMigration(file, name, statements)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(file+".conf", []byte("executeInTransaction=false\n"), 0644)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+func writeMigration(file string, subscriber string, statements []string) error {
+	content := "-- Generated by pg-el-sync for subscriber " + subscriber + "\n\n" + strings.Join(statements, ";\n\n") + ";\n"
+	err := os.WriteFile(file, []byte(content), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migration written to %s\n", file)
+	return nil
 }
 
 // -----------------INTERNALS----------------------------------------------
 
+func (pgSync *PgSync) initReindexLimits() {
+	maxWorkers := pgSync.config.MaxWorkers
+	if maxWorkers <= 0 {
+		maxWorkers = runtime.NumCPU()
+	}
+	pgSync.workers = utils.NewSemaphore(maxWorkers)
+	maxIndices := pgSync.config.MaxIndices
+	if maxIndices <= 0 {
+		maxIndices = max(1, len(pgSync.indices))
+	}
+	pgSync.reindexing = utils.NewSemaphore(maxIndices)
+	pgSync.reindexLocks = make(map[string]*sync.Mutex)
+	for name := range pgSync.indices {
+		pgSync.reindexLocks[name] = &sync.Mutex{}
+	}
+	pgSync.buffering = make(map[string]int)
+	pgSync.catchUps = make(map[string]bool)
+	pgSync.catchUpsAgain = make(map[string]bool)
+}
+
 func (pgSync *PgSync) loadIndices() error {
 	pgSync.indices = make(map[string]*types.Index)
+	rowsLimiter := utils.NewRateLimiter(pgSync.config.MaxRowsPerSecond)
 	for _, mapping := range pgSync.config.Mappings {
 		var index types.Index
 		index.Init(mapping)
+		if rowsLimiter != nil {
+			index.RateLimiters = append(index.RateLimiters, rowsLimiter)
+		}
 
 		//Set subscriber in index
 		subscriberName, ok := mapping["in"]
@@ -193,6 +451,8 @@ func (pgSync *PgSync) loadSubscribers() error {
 		switch config["driver"] {
 		case "pgxpool-trigger":
 			subscriber = &postgresql.Subscriber{}
+		case "pgoutput-replication":
+			subscriber = &postgresql.ReplicationSubscriber{}
 		default:
 			return fmt.Errorf("invalid In Driver: %s", config["driver"])
 		}
@@ -2,12 +2,32 @@ package types
 
 import "github.com/quix-labs/pg-el-sync/internals/utils"
 
+// Acknowledgement is called once every publisher handled the event, Nack when publishing failed
+type Acknowledgement struct {
+	Ack  func()
+	Nack func()
+}
+
+func (acknowledgement *Acknowledgement) Acknowledge() {
+	if acknowledgement.Ack != nil {
+		acknowledgement.Ack()
+	}
+}
+
+func (acknowledgement *Acknowledgement) Reject() {
+	if acknowledgement.Nack != nil {
+		acknowledgement.Nack()
+	}
+}
+
 type InsertEvent struct {
+	Acknowledgement
 	Index     string
 	Reference string
 }
 
 type UpdateEvent struct {
+	Acknowledgement
 	Index                 string
 	Reference             string
 	OldReference          string
@@ -16,6 +36,7 @@ type UpdateEvent struct {
 }
 
 type RelationUpdateEvent struct {
+	Acknowledgement
 	Index     string
 	Relation  string
 	Reference string
@@ -23,13 +44,30 @@ type RelationUpdateEvent struct {
 }
 
 type DeleteEvent struct {
+	Acknowledgement
 	Index     string
 	Reference string
 }
 
+type ReindexEvent struct {
+	Index string
+}
+
 type WaitingEvents struct {
 	Insert          utils.ConcurrentSlice[*InsertEvent]
 	Update          utils.ConcurrentSlice[*UpdateEvent]
 	Delete          utils.ConcurrentSlice[*DeleteEvent]
 	RelationsUpdate utils.ConcurrentSlice[*RelationUpdateEvent]
 }
+
+func acknowledge[T interface{ Acknowledge() }](events []T) {
+	for _, event := range events {
+		event.Acknowledge()
+	}
+}
+
+func reject[T interface{ Reject() }](events []T) {
+	for _, event := range events {
+		event.Reject()
+	}
+}
@@ -10,8 +10,9 @@ type SimpleField struct {
 	Field string
 }
 type ScriptedField struct {
-	Alias  string
-	Script string
+	Alias     string
+	Script    string
+	DependsOn []string // Columns read by the script, any update notifies when undefined
 }
 type Fields struct {
 	Simple   []*SimpleField
@@ -35,9 +36,10 @@ func (fields *Fields) Parse(config any) error {
 
 		case map[string]interface{}:
 			var tempField struct {
-				Alias  string
-				Field  string
-				Script string
+				Alias     string
+				Field     string
+				Script    string
+				DependsOn []string `json:"depends_on"`
 			}
 			err := utils.ParseMap(parsed, &tempField)
 			if err != nil {
@@ -49,7 +51,7 @@ func (fields *Fields) Parse(config any) error {
 			}
 
 			if tempField.Alias != "" && tempField.Script != "" {
-				fields.Scripted = append(fields.Scripted, &ScriptedField{Alias: tempField.Alias, Script: tempField.Script})
+				fields.Scripted = append(fields.Scripted, &ScriptedField{Alias: tempField.Alias, Script: tempField.Script, DependsOn: tempField.DependsOn})
 				continue
 			}
 
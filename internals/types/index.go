@@ -1,28 +1,38 @@
 package types
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/quix-labs/pg-el-sync/internals/utils"
 	"github.com/rs/zerolog"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Index struct {
 	Name      string
+	Schema    string
 	Table     string
 	Fields    Fields
 	Relations Relations
 	Wheres    Wheres
 
-	ReferenceField string
-	Settings       map[string]any
-	Mappings       map[string]any
+	ReferenceFields []string
+	IdTemplate      string
+	Settings        map[string]any
+	Mappings        map[string]any
 
 	Plugins    Plugins
 	Subscriber *AbstractSubscriber
 	Publishers []*AbstractPublisher
 	ChunkSize  int
+	Workers    int // Partitions fetched and published concurrently during a full reindex
+
+	MaxRowsPerSecond int                  // Full reindex rate of the index, 0 for unlimited
+	RateLimiters     []*utils.RateLimiter // Limits applied to full reindex rows, the index one and shared ones
 
 	WaitingEvents *WaitingEvents
 
@@ -83,21 +93,25 @@ func (index *Index) asyncHandleInserts() {
 			for _, event := range results {
 				references = append(references, event.Reference)
 			}
+			var err error
 			insertRows := utils.ConcurrentSlice[*InsertsRow]{}
 			for row := range (*index.Subscriber).GetFullRecordsForIndex(references, index) {
-				insertRows.Append(&InsertsRow{Index: index.Name, Record: row.Data, Reference: row.Reference})
+				if row.Err != nil {
+					err = errors.Join(err, row.Err)
+					continue
+				}
+				insertRows.Append(&InsertsRow{Index: index.Name, Record: row.Data, Reference: index.GetDocumentId(row.Reference)})
 				if insertRows.Len() >= index.ChunkSize {
-					rows := insertRows.Retrieve(index.ChunkSize)
-					for _, publisher := range index.Publishers {
-						(*publisher).Insert(rows)
-					}
+					err = errors.Join(err, index.publishInserts(insertRows.Retrieve(index.ChunkSize)))
 				}
 			}
 			if insertRows.Len() > 0 {
-				rows := insertRows.All()
-				for _, publisher := range index.Publishers {
-					(*publisher).Insert(rows)
-				}
+				err = errors.Join(err, index.publishInserts(insertRows.All()))
+			}
+			if err == nil {
+				acknowledge(results)
+			} else {
+				reject(results)
 			}
 		}
 	}
@@ -115,19 +129,19 @@ func (index *Index) asyncHandleUpdates() {
 			results := index.WaitingEvents.Update.Retrieve(index.ChunkSize)
 
 			// Remove old reference id changes
+			var err error
 			var oldRows []*DeleteRow
 			for _, event := range results {
-				if event.Reference != event.OldReference {
+				oldId := index.GetDocumentId(event.OldReference)
+				if index.GetDocumentId(event.Reference) != oldId {
 					oldRows = append(oldRows, &DeleteRow{
 						Index:     index.Name,
-						Reference: event.OldReference,
+						Reference: oldId,
 					})
 				}
 			}
 			if len(oldRows) > 0 {
-				for _, publisher := range index.Publishers {
-					(*publisher).Delete(oldRows)
-				}
+				err = errors.Join(err, index.publishDeletes(oldRows))
 			}
 
 			// Update rows
@@ -137,19 +151,22 @@ func (index *Index) asyncHandleUpdates() {
 			}
 			updateRows := utils.ConcurrentSlice[*UpdateRow]{}
 			for row := range (*index.Subscriber).GetFullRecordsForIndex(references, index) {
-				updateRows.Append(&UpdateRow{Index: index.Name, Record: row.Data, Reference: row.Reference})
+				if row.Err != nil {
+					err = errors.Join(err, row.Err)
+					continue
+				}
+				updateRows.Append(&UpdateRow{Index: index.Name, Record: row.Data, Reference: index.GetDocumentId(row.Reference)})
 				if updateRows.Len() >= index.ChunkSize {
-					rows := updateRows.Retrieve(index.ChunkSize)
-					for _, publisher := range index.Publishers {
-						(*publisher).Update(rows)
-					}
+					err = errors.Join(err, index.publishUpdates(updateRows.Retrieve(index.ChunkSize)))
 				}
 			}
 			if updateRows.Len() > 0 {
-				rows := updateRows.All()
-				for _, publisher := range index.Publishers {
-					(*publisher).Update(rows)
-				}
+				err = errors.Join(err, index.publishUpdates(updateRows.All()))
+			}
+			if err == nil {
+				acknowledge(results)
+			} else {
+				reject(results)
 			}
 		}
 	}
@@ -169,12 +186,14 @@ func (index *Index) asyncHandleDeletes() {
 			var rows []*DeleteRow
 			for _, event := range results {
 				rows = append(rows, &DeleteRow{
-					Reference: event.Reference,
+					Reference: index.GetDocumentId(event.Reference),
 					Index:     index.Name,
 				})
 			}
-			for _, publisher := range index.Publishers {
-				(*publisher).Delete(rows)
+			if index.publishDeletes(rows) == nil {
+				acknowledge(results)
+			} else {
+				reject(results)
 			}
 		}
 	}
@@ -195,50 +214,153 @@ func (index *Index) asyncHandleRelationsUpdates() {
 				relation := index.GetAllRelations()[event.Relation]
 				indexedResults[relation] = utils.Unique(append(indexedResults[relation], event))
 			}
+			var err error
 			updateRows := utils.ConcurrentSlice[*UpdateRow]{}
 			for row := range (*index.Subscriber).GetFullRecordsForRelationUpdate(indexedResults, index) {
-				updateRows.Append(&UpdateRow{Index: index.Name, Record: row.Data, Reference: row.Reference})
+				if row.Err != nil {
+					err = errors.Join(err, row.Err)
+					continue
+				}
+				updateRows.Append(&UpdateRow{Index: index.Name, Record: row.Data, Reference: index.GetDocumentId(row.Reference)})
 
 				if updateRows.Len() >= index.ChunkSize {
-					rows := updateRows.Retrieve(index.ChunkSize)
-					for _, publisher := range index.Publishers {
-						(*publisher).Update(rows)
-					}
+					err = errors.Join(err, index.publishUpdates(updateRows.Retrieve(index.ChunkSize)))
 				}
 			}
 			if updateRows.Len() > 0 {
-				rows := updateRows.All()
-				for _, publisher := range index.Publishers {
-					(*publisher).Update(rows)
-				}
+				err = errors.Join(err, index.publishUpdates(updateRows.All()))
+			}
+			if err == nil {
+				acknowledge(results)
+			} else {
+				reject(results)
 			}
 		}
 	}
 }
 
+func (index *Index) publishInserts(rows []*InsertsRow) error {
+	var err error
+	for _, publisher := range index.Publishers {
+		err = errors.Join(err, (*publisher).Insert(rows))
+	}
+	return err
+}
+func (index *Index) publishUpdates(rows []*UpdateRow) error {
+	var err error
+	for _, publisher := range index.Publishers {
+		err = errors.Join(err, (*publisher).Update(rows))
+	}
+	return err
+}
+func (index *Index) publishDeletes(rows []*DeleteRow) error {
+	var err error
+	for _, publisher := range index.Publishers {
+		err = errors.Join(err, (*publisher).Delete(rows))
+	}
+	return err
+}
+
 //------------------PREPARATION FUNCTIONS---------------------------------------
 
-func (index *Index) IndexAllDocuments() {
+func (index *Index) IndexAllDocuments(workers int, mode ReindexMode) error {
 	fmt.Printf("Index all documents for %s\n", index.Name)
+	partitions, err := (*index.Subscriber).GetAllRecordsForIndex(index, workers, mode)
+	if err != nil {
+		return err
+	}
+	// Catch-ups delete documents of rows deleted while events were lost
+	var published *utils.ConcurrentSet[string]
+	if mode == ReindexCatchUp {
+		published = utils.NewConcurrentSet[string]()
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(partitions))
+	for i, partition := range partitions {
+		wg.Add(1)
+		go func(i int, records <-chan Record) {
+			defer wg.Done()
+			errs[i] = index.indexRecords(records, published)
+		}(i, partition)
+	}
+	wg.Wait()
+	err = errors.Join(errs...)
+	if err != nil || published == nil {
+		return err
+	}
+	return index.deleteUnpublished(published)
+}
+
+// indexRecords save the checkpoint of the last record once its chunk is published
+func (index *Index) indexRecords(records <-chan Record, published *utils.ConcurrentSet[string]) error {
 	insertRows := utils.ConcurrentSlice[*InsertsRow]{}
-	for row := range (*index.Subscriber).GetAllRecordsForIndex(index) {
+	var checkpoint func()
+	var firstErr error
+	publish := func(rows []*InsertsRow) {
+		err := index.publishInserts(rows)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if firstErr == nil && checkpoint != nil {
+			checkpoint()
+		}
+		if published != nil {
+			for _, row := range rows {
+				published.Add(row.Reference)
+			}
+		}
+	}
+	for row := range records {
+		if row.Err != nil {
+			if firstErr == nil {
+				firstErr = row.Err
+			}
+			continue
+		}
+		for _, limiter := range index.RateLimiters {
+			limiter.Wait(1)
+		}
 
 		index.Plugins.Apply(&row)
 
-		insertRows.Append(&InsertsRow{Index: index.Name, Record: row.Data, Reference: row.Reference})
+		insertRows.Append(&InsertsRow{Index: index.Name, Record: row.Data, Reference: index.GetDocumentId(row.Reference)})
+		checkpoint = row.Checkpoint
 		if insertRows.Len() >= index.ChunkSize {
-			rows := insertRows.Retrieve(index.ChunkSize)
-			for _, publisher := range index.Publishers {
-				(*publisher).Insert(rows)
-			}
+			publish(insertRows.Retrieve(index.ChunkSize))
 		}
 	}
 	if insertRows.Len() > 0 {
-		rows := insertRows.All()
-		for _, publisher := range index.Publishers {
-			(*publisher).Insert(rows)
+		publish(insertRows.All())
+	}
+	return firstErr
+}
+
+func (index *Index) deleteUnpublished(published *utils.ConcurrentSet[string]) error {
+	var errs []error
+	for _, publisher := range index.Publishers {
+		deleted := 0
+		err := (*publisher).ScanIds(index.Name, func(ids []string) error {
+			var rows []*DeleteRow
+			for _, id := range ids {
+				if !published.Contains(id) {
+					rows = append(rows, &DeleteRow{Index: index.Name, Reference: id})
+				}
+			}
+			if len(rows) == 0 {
+				return nil
+			}
+			deleted += len(rows)
+			return (*publisher).Delete(rows)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot delete unpublished documents: %w", err))
+			continue
+		}
+		if deleted > 0 {
+			fmt.Printf("Deleted %d documents of %s without row\n", deleted, index.Name)
 		}
 	}
+	return errors.Join(errs...)
 }
 
 // ----------------------------------PARSING--------------------------------------
@@ -261,10 +383,31 @@ func (index *Index) Parse(config map[string]interface{}) error {
 	if err != nil {
 		index.Logger.Fatal().Err(err).Msg("Invalid table for mapping")
 	}
-	err = utils.ParseMapKey(config, "reference_field", &index.ReferenceField)
+	err = utils.ParseMapKey(config, "schema", &index.Schema)
 	if err != nil {
-		index.ReferenceField = "id"
-		index.Logger.Info().Msg("Invalid or unspecified reference_field for mapping, default to id")
+		index.Schema = ""
+	}
+	if _, exists := config["reference_fields"]; exists {
+		err = utils.ParseMapKey(config, "reference_fields", &index.ReferenceFields)
+		if err != nil || len(index.ReferenceFields) == 0 {
+			index.Logger.Fatal().Err(err).Msg("Invalid reference_fields for mapping")
+		}
+	} else {
+		var referenceField string
+		err = utils.ParseMapKey(config, "reference_field", &referenceField)
+		if err != nil {
+			referenceField = "id"
+			index.Logger.Info().Msg("Invalid or unspecified reference_field for mapping, default to id")
+		}
+		index.ReferenceFields = []string{referenceField}
+	}
+	err = utils.ParseMapKey(config, "id_template", &index.IdTemplate)
+	if err != nil && len(index.ReferenceFields) > 1 {
+		var placeholders []string
+		for _, field := range index.ReferenceFields {
+			placeholders = append(placeholders, "{{"+field+"}}")
+		}
+		index.IdTemplate = strings.Join(placeholders, ":")
 	}
 	err = utils.ParseMapKey(config, "chunk_size", &index.ChunkSize)
 	if err != nil {
@@ -272,6 +415,16 @@ func (index *Index) Parse(config map[string]interface{}) error {
 		index.Logger.Info().Msg("Invalid or unspecified chunk_size for mapping, default to 500")
 	}
 
+	err = utils.ParseMapKey(config, "workers", &index.Workers)
+	if err != nil || index.Workers < 1 {
+		index.Workers = 1
+	}
+
+	err = utils.ParseMapKey(config, "max_rows_per_second", &index.MaxRowsPerSecond)
+	if err == nil && index.MaxRowsPerSecond > 0 {
+		index.RateLimiters = append(index.RateLimiters, utils.NewRateLimiter(index.MaxRowsPerSecond))
+	}
+
 	if _, exists := config["plugins"]; exists {
 		err = index.Plugins.Parse(config["plugins"])
 		if err != nil {
@@ -299,6 +452,22 @@ func (index *Index) Parse(config map[string]interface{}) error {
 
 	return nil
 }
+
+func (index *Index) GetDocumentId(reference string) string {
+	if index.IdTemplate == "" {
+		return reference
+	}
+	values := DecodeReference(reference, len(index.ReferenceFields))
+	if values == nil {
+		return reference
+	}
+	id := index.IdTemplate
+	for i, field := range index.ReferenceFields {
+		id = strings.ReplaceAll(id, "{{"+field+"}}", values[i])
+	}
+	return id
+}
+
 func (index *Index) GetAllRelations() Relations {
 	relations := make(Relations)
 	for relName, rel := range index.Relations {
@@ -332,3 +501,36 @@ func (index *Index) GetAllMapping() map[string]any {
 	}
 	return mappings
 }
+
+// EncodeReference build the reference of a composite key as a json array of text values
+func EncodeReference(values []*string) string {
+	missing := true
+	for _, value := range values {
+		missing = missing && value == nil
+	}
+	if missing {
+		return ""
+	}
+	if len(values) == 1 {
+		return *values[0]
+	}
+	encoded, _ := json.Marshal(values)
+	return string(encoded)
+}
+
+func DecodeReference(reference string, size int) []string {
+	if size == 1 {
+		return []string{reference}
+	}
+	var values []*string
+	if json.Unmarshal([]byte(reference), &values) != nil || len(values) != size {
+		return nil
+	}
+	decoded := make([]string, size)
+	for i, value := range values {
+		if value != nil {
+			decoded[i] = *value
+		}
+	}
+	return decoded
+}
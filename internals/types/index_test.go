@@ -0,0 +1,59 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func reference(v string) *string {
+	return &v
+}
+
+func TestEncodeReference(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []*string
+		expected string
+	}{
+		{name: "single value", values: []*string{reference("42")}, expected: "42"},
+		{name: "missing single value", values: []*string{nil}, expected: ""},
+		{name: "composite values", values: []*string{reference("1"), reference(`a"b`)}, expected: `["1","a\"b"]`},
+		{name: "composite with missing value", values: []*string{reference("1"), nil}, expected: `["1",null]`},
+		{name: "all values missing", values: []*string{nil, nil}, expected: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if encoded := EncodeReference(test.values); encoded != test.expected {
+				t.Errorf("got %s, expected %s", encoded, test.expected)
+			}
+		})
+	}
+}
+
+func TestDecodeReference(t *testing.T) {
+	tests := []struct {
+		name      string
+		reference string
+		size      int
+		expected  []string
+	}{
+		{name: "single value", reference: "42", size: 1, expected: []string{"42"}},
+		{name: "single value looking like json", reference: `["1","2"]`, size: 1, expected: []string{`["1","2"]`}},
+		{name: "composite values", reference: `["1","a\"b"]`, size: 2, expected: []string{"1", `a"b`}},
+		{name: "composite with missing value", reference: `["1",null]`, size: 2, expected: []string{"1", ""}},
+		{name: "malformed", reference: "1,2", size: 2, expected: nil},
+		{name: "size mismatch", reference: `["1","2","3"]`, size: 2, expected: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if decoded := DecodeReference(test.reference, test.size); !reflect.DeepEqual(decoded, test.expected) {
+				t.Errorf("got %#v, expected %#v", decoded, test.expected)
+			}
+		})
+	}
+
+	values := []*string{reference("1"), reference("x")}
+	if decoded := DecodeReference(EncodeReference(values), 2); !reflect.DeepEqual(decoded, []string{"1", "x"}) {
+		t.Errorf("round trip returned %#v", decoded)
+	}
+}
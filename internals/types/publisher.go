@@ -6,9 +6,10 @@ type AbstractPublisher interface {
 
 	InternalInit(name string)
 	InternalTerminate()
-	Insert(rows []*InsertsRow)
-	Update(rows []*UpdateRow)
-	Delete(rows []*DeleteRow)
+	Insert(rows []*InsertsRow) error
+	Update(rows []*UpdateRow) error
+	Delete(rows []*DeleteRow) error
+	ScanIds(index string, handle func(ids []string) error) error
 }
 
 type InsertsRow struct {
@@ -10,15 +10,17 @@ type ForeignKey struct {
 	Parent       string
 	PivotLocal   string `json:"pivot_local"`
 	PivotTable   string `json:"pivot_table"`
+	PivotSchema  string `json:"pivot_schema"`
 	PivotFields  Fields
 	PivotRelated string `json:"pivot_related"`
 }
 type Relation struct {
-	Table string
-	Name  string
+	Schema string
+	Table  string
+	Name   string
 
 	Type       string // 'one_to_one', 'one_to_many', 'many_to_many'
-	SoftDelete bool
+	SoftDelete *Where // Condition of active rows, nil when rows are never soft deleted
 	Fields     Fields
 
 	Wheres    Wheres
@@ -31,9 +33,7 @@ type Relation struct {
 	ForeignKey ForeignKey
 	UniqueName string
 
-	UsingView   bool
-	ViewName    string
-	ViewCreated bool
+	UsingView bool
 }
 type Relations map[string]*Relation
 
@@ -77,9 +77,13 @@ func (relation *Relation) Parse(config any, parent *Relation) error {
 	if err != nil {
 		return err
 	}
-	err = utils.ParseMapKey(rel, "soft_delete", &relation.SoftDelete)
+	err = utils.ParseMapKey(rel, "schema", &relation.Schema)
 	if err != nil {
-		relation.SoftDelete = false
+		relation.Schema = ""
+	}
+	err = relation.parseSoftDelete(rel["soft_delete"])
+	if err != nil {
+		return err
 	}
 	err = utils.ParseMapKey(rel, "using_view", &relation.UsingView)
 	if err != nil {
@@ -126,7 +130,25 @@ func (relation *Relation) Parse(config any, parent *Relation) error {
 		}
 	}
 	relation.UniqueName = relation.getUniqueName()
-	relation.ViewName = relation.UniqueName + "_tmp_view"
+	return nil
+}
+
+func (relation *Relation) parseSoftDelete(config any) error {
+	switch parsed := config.(type) {
+	case nil:
+		return nil
+	case bool:
+		if parsed {
+			relation.SoftDelete = &Where{Column: "deleted_at", Condition: "IS NULL"}
+		}
+		return nil
+	}
+	var softDelete Where
+	err := utils.ParseMap(config, &softDelete)
+	if err != nil || softDelete.Column == "" || softDelete.Condition == "" {
+		return errors.New("invalid soft_delete for relation, expected a boolean or a column and condition")
+	}
+	relation.SoftDelete = &softDelete
 	return nil
 }
 
@@ -2,21 +2,39 @@ package types
 
 type AbstractSubscriber interface {
 	Init(config map[string]any)
+	Install()
 
 	PrepareListen(indices []*Index)
 	Listen()
 	Terminate()
+	Teardown(indices []*Index, dryRun bool) error
+	GetInstallStatements(indices []*Index) []string
+	GetNonTransactionalStatements(indices []*Index) []string
+	// ExportSnapshot pin the data read by GetAllRecordsForIndex until release is called
+	ExportSnapshot() (release func(), err error)
 
 	InternalInit(eventChannel *chan *interface{}, name string)
 	InternalTerminate()
 	DispatchEvent(event *interface{})
 
-	GetAllRecordsForIndex(index *Index) <-chan Record
+	// GetAllRecordsForIndex send a record holding the error before closing a failed channel
+	GetAllRecordsForIndex(index *Index, partitions int, mode ReindexMode) ([]<-chan Record, error)
 	GetFullRecordsForIndex(references []string, index *Index) <-chan Record
 	GetFullRecordsForRelationUpdate(results RelationsUpdate, index *Index) <-chan Record
 }
 
+type ReindexMode int
+
+const (
+	ReindexFull    ReindexMode = iota // Replace checkpoints
+	ReindexResume                     // Skip records published according to checkpoints, then update them
+	ReindexCatchUp                    // Ignore checkpoints, so a manual run interrupted can still be resumed
+)
+
 type Record struct {
 	Reference string
 	Data      map[string]interface{}
+
+	Checkpoint func() // Save the position of the record, called once it and previous records are published
+	Err        error  // Reading failed, no record follows
 }
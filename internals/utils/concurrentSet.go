@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"sync"
+)
+
+type ConcurrentSet[T comparable] struct {
+	rw    sync.RWMutex
+	items map[T]struct{}
+}
+
+func NewConcurrentSet[T comparable]() *ConcurrentSet[T] {
+	return &ConcurrentSet[T]{items: make(map[T]struct{})}
+}
+
+func (cs *ConcurrentSet[T]) Add(item T) {
+	cs.rw.Lock()
+	defer cs.rw.Unlock()
+	cs.items[item] = struct{}{}
+}
+func (cs *ConcurrentSet[T]) Contains(item T) bool {
+	cs.rw.RLock()
+	defer cs.rw.RUnlock()
+	_, exists := cs.items[item]
+	return exists
+}
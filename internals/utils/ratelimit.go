@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter spread units so at most rate are consumed per second, nil does not limit
+type RateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func NewRateLimiter(rate int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: time.Second / time.Duration(rate)}
+}
+
+func (r *RateLimiter) Wait(count int) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval * time.Duration(count))
+	r.lock.Unlock()
+	time.Sleep(wait)
+}
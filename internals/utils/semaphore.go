@@ -0,0 +1,29 @@
+package utils
+
+import "sync"
+
+type Semaphore struct {
+	lock  sync.Mutex
+	slots chan struct{}
+}
+
+func NewSemaphore(size int) *Semaphore {
+	return &Semaphore{slots: make(chan struct{}, size)}
+}
+
+// Acquire hold at most the semaphore size, one caller at a time so callers cannot deadlock
+func (s *Semaphore) Acquire(count int) int {
+	count = max(1, min(count, cap(s.slots)))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := 0; i < count; i++ {
+		s.slots <- struct{}{}
+	}
+	return count
+}
+
+func (s *Semaphore) Release(count int) {
+	for i := 0; i < count; i++ {
+		<-s.slots
+	}
+}
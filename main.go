@@ -9,7 +9,7 @@ import (
 func main() {
 	args := os.Args[1:]
 	if len(args) == 0 {
-		log.Fatalln("You need to specify action [ listen | index ]")
+		log.Fatalln("You need to specify action [ listen [--reindex] | index [--resume] | teardown [--dry-run] | export-sql [directory] ]")
 	}
 
 	config := &internals.Config{}
@@ -32,13 +32,41 @@ func main() {
 
 	switch args[0] {
 	case "listen":
+		pgSync.Install()
 		//sigs := make(chan os.Signal, 1)
 		//signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-		go pgSync.Start()
+		if len(args) > 1 && args[1] == "--reindex" {
+			err = pgSync.StartWithReindex()
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			go pgSync.Start()
+		}
 		select {}
 		//<-sigs
 	case "index":
-		pgSync.FullReindex()
+		pgSync.Install()
+		resume := len(args) > 1 && args[1] == "--resume"
+		err = pgSync.FullReindex(resume)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "teardown":
+		dryRun := len(args) > 1 && args[1] == "--dry-run"
+		err = pgSync.Teardown(dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "export-sql":
+		directory := "."
+		if len(args) > 1 {
+			directory = args[1]
+		}
+		err = pgSync.ExportMigration(directory)
+		if err != nil {
+			log.Fatal(err)
+		}
 	case "stats":
 		log.Fatalln("Not implemented")
 	default:
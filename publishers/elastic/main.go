@@ -4,10 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	elasticsearch8 "github.com/elastic/go-elasticsearch/v8"
 	"github.com/quix-labs/pg-el-sync/internals/types"
 	"github.com/quix-labs/pg-el-sync/publishers"
+	"net/http"
 	"sync"
+	"time"
+)
+
+const (
+	ScrollSize      = 1000
+	ScrollKeepAlive = time.Minute
 )
 
 type Publisher struct {
@@ -56,7 +64,7 @@ func (p *Publisher) Init(config map[string]interface{}, indices []*types.Index)
 
 }
 
-func (p *Publisher) Insert(rows []*types.InsertsRow) {
+func (p *Publisher) Insert(rows []*types.InsertsRow) error {
 	var body [][]byte
 	for _, row := range rows {
 		data, err := json.Marshal(row.Record)
@@ -64,13 +72,13 @@ func (p *Publisher) Insert(rows []*types.InsertsRow) {
 			p.Logger.Print(err)
 			continue
 		}
-		body = append(body, []byte(`{"index":{"_index":"`+p.Prefix+row.Index+`","_id":"`+row.Reference+`"}}`), data)
+		body = append(body, p.getBulkAction("index", row.Index, row.Reference), data)
 	}
 	//p.Logger.Debug().Msgf("SEND INSERT BULK - SIZE: %d", len(body))
-	p.sendBulk(body)
+	return p.sendBulk(body)
 }
 
-func (p *Publisher) Update(rows []*types.UpdateRow) {
+func (p *Publisher) Update(rows []*types.UpdateRow) error {
 	var body [][]byte
 	for _, row := range rows {
 		data, err := json.Marshal(row.Record)
@@ -78,36 +86,145 @@ func (p *Publisher) Update(rows []*types.UpdateRow) {
 			p.Logger.Print(err)
 			continue
 		}
-		body = append(body, []byte(`{"index":{"_index":"`+p.Prefix+row.Index+`","_id":"`+row.Reference+`"}}`), data)
+		body = append(body, p.getBulkAction("index", row.Index, row.Reference), data)
 	}
 	//p.Logger.Debug().Msgf("SEND UPDATE BULK - SIZE: %d", len(body))
-	p.sendBulk(body)
+	return p.sendBulk(body)
 }
 
-func (p *Publisher) Delete(rows []*types.DeleteRow) {
+func (p *Publisher) Delete(rows []*types.DeleteRow) error {
 	var body [][]byte
 	for _, row := range rows {
-		body = append(body, []byte(`{"delete":{"_index":"`+p.Prefix+row.Index+`","_id":"`+row.Reference+`"}}`))
+		body = append(body, p.getBulkAction("delete", row.Index, row.Reference))
 	}
 	//p.Logger.Debug().Msgf("SEND DELETE BULK - SIZE: %d", len(body))
-	p.sendBulk(body)
+	return p.sendBulk(body)
 }
 
-func (p *Publisher) sendBulk(rows [][]byte) {
+func (p *Publisher) getBulkAction(action string, index string, reference string) []byte {
+	line, _ := json.Marshal(map[string]map[string]string{
+		action: {"_index": p.Prefix + index, "_id": reference},
+	})
+	return line
+}
+
+func (p *Publisher) sendBulk(rows [][]byte) error {
 	p.Lock()
 	defer p.Unlock()
 	fullBody := append(bytes.Join(rows, []byte("\n")), "\n"...)
 	res, err := p.client.Bulk(bytes.NewReader(fullBody))
 	if err != nil {
 		p.Logger.Err(err)
-		return
+		return err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		p.Logger.Printf("Error sending bulk request", res.String())
+		p.Logger.Printf("Error sending bulk request: %s", res.String())
+		return errors.New("bulk request failed: " + res.Status())
+	}
+
+	var response bulkResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("cannot decode bulk response: %w", err)
+	}
+	if !response.Errors {
+		return nil
 	}
+	// Rejected items are retried, others can never be indexed and are only logged
+	retryable := 0
+	for _, item := range response.Items {
+		for action, result := range item {
+			if result.Error == nil {
+				continue
+			}
+			p.Logger.Printf("Cannot %s %s in %s (%d): %s: %s", action, result.Id, result.Index, result.Status, result.Error.Type, result.Error.Reason)
+			if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+				retryable++
+			}
+		}
+	}
+	if retryable > 0 {
+		return fmt.Errorf("bulk request failed for %d items", retryable)
+	}
+	return nil
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Index  string `json:"_index"`
+	Id     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+func (p *Publisher) ScanIds(index string, handle func(ids []string) error) error {
+	res, err := p.client.Search(
+		p.client.Search.WithIndex(p.Prefix+index),
+		p.client.Search.WithScroll(ScrollKeepAlive),
+		p.client.Search.WithSize(ScrollSize),
+		p.client.Search.WithSource("false"),
+		p.client.Search.WithSort("_doc"),
+	)
+	var scrollId string
+	defer func() {
+		if scrollId == "" {
+			return
+		}
+		res, err := p.client.ClearScroll(p.client.ClearScroll.WithScrollID(scrollId))
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	for {
+		if err != nil {
+			return err
+		}
+		if res.StatusCode == http.StatusNotFound {
+			res.Body.Close()
+			return nil
+		}
+		if res.IsError() {
+			res.Body.Close()
+			return errors.New("scroll request failed: " + res.String())
+		}
+		var response scrollResponse
+		err = json.NewDecoder(res.Body).Decode(&response)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot decode scroll response: %w", err)
+		}
+		scrollId = response.ScrollId
+		if len(response.Hits.Hits) == 0 {
+			return nil
+		}
+		var ids []string
+		for _, hit := range response.Hits.Hits {
+			ids = append(ids, hit.Id)
+		}
+		err = handle(ids)
+		if err != nil {
+			return err
+		}
+		res, err = p.client.Scroll(p.client.Scroll.WithScrollID(scrollId), p.client.Scroll.WithScroll(ScrollKeepAlive))
+	}
+}
 
+type scrollResponse struct {
+	ScrollId string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			Id string `json:"_id"`
+		} `json:"hits"`
+	} `json:"hits"`
 }
 
 func (p *Publisher) Terminate() {}
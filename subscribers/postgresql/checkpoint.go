@@ -0,0 +1,124 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+)
+
+// checkpoint is the range of references of a partition and its last published reference, nil when unbounded
+type checkpoint struct {
+	Partition int
+	After     *string
+	UpTo      *string
+	Position  *string
+}
+
+func (pg *Subscriber) getCheckpointTableSql() string {
+	return fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS "%s"."%s" ("index_name" TEXT NOT NULL, "partition" INT NOT NULL, "after" TEXT, "up_to" TEXT, "position" TEXT, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(), PRIMARY KEY ("index_name", "partition"))`,
+		pg.Schema, CheckpointTableName,
+	)
+}
+
+func (pg *Subscriber) getCheckpoints(conn *pgxpool.Pool, query string, k keyset, partitions int) []checkpoint {
+	var bounds []string
+	if partitions > 1 {
+		var err error
+		bounds, err = pg.getPartitionBounds(conn, query, k, partitions)
+		if err != nil {
+			pg.Logger.Printf("Cannot compute partitions, fetching sequentially: %s", err)
+			bounds = nil
+		}
+	}
+	checkpoints := make([]checkpoint, len(bounds)+1)
+	for i := range checkpoints {
+		checkpoints[i].Partition = i
+		if i > 0 {
+			checkpoints[i].After = &bounds[i-1]
+		}
+		if i < len(bounds) {
+			checkpoints[i].UpTo = &bounds[i]
+		}
+	}
+	return checkpoints
+}
+
+func (c checkpoint) getConditionsSql(k keyset, args *queryArgs) []string {
+	var conditions []string
+	after := c.After
+	if c.Position != nil {
+		after = c.Position
+	}
+	if after != nil {
+		conditions = append(conditions, k.getAfterSql(*after, args))
+	}
+	if c.UpTo != nil {
+		conditions = append(conditions, k.getUpToSql(*c.UpTo, args))
+	}
+	return conditions
+}
+
+func (pg *Subscriber) loadCheckpoints(index string) ([]checkpoint, error) {
+	rows, err := pg.conn.Query(context.Background(), fmt.Sprintf(
+		`SELECT "partition", "after", "up_to", "position" FROM "%s"."%s" WHERE "index_name" = $1 ORDER BY "partition"`,
+		pg.Schema, CheckpointTableName,
+	), index)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[checkpoint])
+}
+
+func (pg *Subscriber) saveCheckpoints(index string, checkpoints []checkpoint) error {
+	tx, err := pg.conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE "index_name" = $1`, pg.Schema, CheckpointTableName), index)
+	if err != nil {
+		return err
+	}
+	for _, c := range checkpoints {
+		_, err = tx.Exec(context.Background(), fmt.Sprintf(
+			`INSERT INTO "%s"."%s" ("index_name", "partition", "after", "up_to") VALUES ($1, $2, $3, $4)`,
+			pg.Schema, CheckpointTableName,
+		), index, c.Partition, c.After, c.UpTo)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+func (run *stagingRun) savePosition(index string, partition int, reference string) {
+	run.connLock.Lock()
+	defer run.connLock.Unlock()
+	_, err := run.conn.Exec(context.Background(), fmt.Sprintf(
+		`UPDATE "%s"."%s" SET "position" = $3, "updated_at" = now() WHERE "index_name" = $1 AND "partition" = $2`,
+		run.pg.Schema, CheckpointTableName,
+	), index, partition, reference)
+	if err != nil {
+		run.pg.Logger.Printf("Cannot save checkpoint of %s partition %d: %s", index, partition, err)
+	}
+}
+
+func (pg *Subscriber) reportSkipped(conn *pgxpool.Pool, index string, query string, k keyset, c checkpoint) {
+	if c.Position == nil {
+		pg.Logger.Printf("Resuming %s partition %d from its start", index, c.Partition)
+		return
+	}
+	args := queryArgs{}
+	conditions := checkpoint{After: c.After, UpTo: c.Position}.getConditionsSql(k, &args)
+	var skipped int64
+	err := conn.QueryRow(context.Background(), `SELECT count(*) FROM (`+query+` WHERE `+strings.Join(conditions, " AND ")+`) AS "skipped"`, args...).Scan(&skipped)
+	if err != nil {
+		pg.Logger.Printf("Resuming %s partition %d after %s", index, c.Partition, *c.Position)
+		return
+	}
+	pg.Logger.Printf("Resuming %s partition %d after %s, %d documents skipped", index, c.Partition, *c.Position, skipped)
+}
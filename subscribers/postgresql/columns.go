@@ -0,0 +1,109 @@
+package postgresql
+
+import (
+	"fmt"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"sort"
+	"strings"
+)
+
+// columnSet collect the columns read to build documents, nil when dependencies are unknown
+type columnSet map[string]bool
+
+func (set columnSet) add(columns ...string) {
+	for _, column := range columns {
+		set[column] = true
+	}
+}
+
+func (set columnSet) addFields(fields types.Fields) bool {
+	for _, field := range fields.Simple {
+		set.add(field.Field)
+	}
+	for _, field := range fields.Scripted {
+		if len(field.DependsOn) == 0 {
+			return false
+		}
+		set.add(field.DependsOn...)
+	}
+	return true
+}
+
+func (set columnSet) addWheres(wheres types.Wheres) {
+	for _, where := range wheres {
+		set.add(where.Column)
+	}
+}
+
+func (set columnSet) sorted() []string {
+	if set == nil {
+		return nil
+	}
+	columns := make([]string, 0, len(set))
+	for column := range set {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func getIndexColumns(index *types.Index) []string {
+	set := columnSet{}
+	if !set.addFields(index.Fields) {
+		return nil
+	}
+	set.add(index.ReferenceFields...)
+	set.addWheres(index.Wheres)
+	for _, relation := range index.Relations {
+		set.add(relation.ForeignKey.Parent)
+	}
+	return set.sorted()
+}
+
+func getRelationColumns(relation *types.Relation) []string {
+	set := columnSet{}
+	if !set.addFields(relation.Fields) {
+		return nil
+	}
+	set.add(relation.ForeignKey.Local)
+	set.addWheres(relation.Wheres)
+	if relation.SoftDelete != nil {
+		set.add(relation.SoftDelete.Column)
+	}
+	for _, child := range relation.Relations {
+		set.add(child.ForeignKey.Parent)
+	}
+	return set.sorted()
+}
+
+func getPivotColumns(relation *types.Relation) []string {
+	set := columnSet{}
+	if !set.addFields(relation.ForeignKey.PivotFields) {
+		return nil
+	}
+	set.add(relation.ForeignKey.PivotLocal, relation.ForeignKey.PivotRelated)
+	return set.sorted()
+}
+
+func getColumnsChangedSql(newRow string, oldRow string, columns []string) string {
+	if columns == nil {
+		return fmt.Sprintf(`to_jsonb(%s) IS DISTINCT FROM to_jsonb(%s)`, newRow, oldRow)
+	}
+	var newColumns, oldColumns []string
+	for _, column := range columns {
+		newColumns = append(newColumns, fmt.Sprintf(`%s."%s"`, newRow, column))
+		oldColumns = append(oldColumns, fmt.Sprintf(`%s."%s"`, oldRow, column))
+	}
+	return fmt.Sprintf(`to_jsonb(ROW(%s)) IS DISTINCT FROM to_jsonb(ROW(%s))`, strings.Join(newColumns, ", "), strings.Join(oldColumns, ", "))
+}
+
+func getRowEvents(columns []string) string {
+	if columns == nil {
+		return rowEvents
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = `"` + column + `"`
+	}
+	return "DELETE OR UPDATE OF " + strings.Join(quoted, ", ") + " OR INSERT"
+}
@@ -0,0 +1,106 @@
+package postgresql
+
+import (
+	"fmt"
+	"github.com/quix-labs/pg-el-sync/internals/utils"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var connectionKeys = map[string]string{
+	"host":                     "host",
+	"port":                     "port",
+	"database":                 "dbname",
+	"username":                 "user",
+	"password":                 "password",
+	"sslmode":                  "sslmode",
+	"sslrootcert":              "sslrootcert",
+	"sslcert":                  "sslcert",
+	"sslkey":                   "sslkey",
+	"sslpassword":              "sslpassword",
+	"connect_timeout":          "connect_timeout",
+	"application_name":         "application_name",
+	"search_path":              "search_path",
+	"statement_timeout":        "statement_timeout",
+	"pool_min_conns":           "pool_min_conns",
+	"pool_max_conns":           "pool_max_conns",
+	"pool_max_conn_lifetime":   "pool_max_conn_lifetime",
+	"pool_max_conn_idle_time":  "pool_max_conn_idle_time",
+	"pool_health_check_period": "pool_health_check_period",
+}
+
+// getConnString merge the dsn with the explicit keys of config, which take precedence
+func getConnString(config map[string]any) (string, error) {
+	var dsn string
+	err := utils.ParseMapKey(config, "dsn", &dsn)
+	if err != nil {
+		dsn = ""
+	}
+
+	params := map[string]string{}
+	for key, param := range connectionKeys {
+		if value, exists := config[key]; exists && value != nil {
+			params[param] = fmt.Sprint(value)
+		}
+	}
+	var extraParams map[string]any
+	if utils.ParseMapKey(config, "params", &extraParams) == nil {
+		for param, value := range extraParams {
+			params[param] = fmt.Sprint(value)
+		}
+	}
+	defaults := map[string]string{
+		"application_name": ApplicationName,
+		"pool_min_conns":   fmt.Sprint(PoolMinConn),
+		"pool_max_conns":   fmt.Sprint(PoolMaxConn),
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		parsed, err := url.Parse(dsn)
+		if err != nil {
+			return "", fmt.Errorf("invalid dsn: %w", err)
+		}
+		query := parsed.Query()
+		for param, value := range defaults {
+			if !query.Has(param) {
+				query.Set(param, value)
+			}
+		}
+		for param, value := range params {
+			query.Set(param, value)
+		}
+		parsed.RawQuery = query.Encode()
+		return parsed.String(), nil
+	}
+
+	// In keyword/value strings, the last occurrence of a parameter wins
+	var pairs []string
+	for _, param := range sortedKeys(defaults) {
+		if !strings.Contains(dsn, param+"=") {
+			pairs = append(pairs, param+"="+quoteConnValue(defaults[param]))
+		}
+	}
+	if dsn != "" {
+		pairs = append(pairs, dsn)
+	}
+	for _, param := range sortedKeys(params) {
+		pairs = append(pairs, param+"="+quoteConnValue(params[param]))
+	}
+	return strings.Join(pairs, " "), nil
+}
+
+func quoteConnValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return `'` + value + `'`
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package postgresql
+
+import "testing"
+
+func TestGetConnString(t *testing.T) {
+	defaults := "application_name='PgSync_Listener' pool_max_conns='5' pool_min_conns='2'"
+	tests := []struct {
+		name     string
+		config   map[string]any
+		expected string
+	}{
+		{
+			name:     "explicit keys",
+			config:   map[string]any{"host": "localhost", "port": 5432, "database": "app", "username": "sync"},
+			expected: defaults + " dbname='app' host='localhost' port='5432' user='sync'",
+		},
+		{
+			name:     "keyword/value dsn",
+			config:   map[string]any{"dsn": "host=db dbname=app"},
+			expected: defaults + " host=db dbname=app",
+		},
+		{
+			name:     "keyword/value dsn defining a default",
+			config:   map[string]any{"dsn": "host=db pool_max_conns=20"},
+			expected: "application_name='PgSync_Listener' pool_min_conns='2' host=db pool_max_conns=20",
+		},
+		{
+			name:     "explicit keys override keyword/value dsn",
+			config:   map[string]any{"dsn": "host=db port=5432", "port": 6432, "params": map[string]any{"target_session_attrs": "read-write"}},
+			expected: defaults + " host=db port=5432 port='6432' target_session_attrs='read-write'",
+		},
+		{
+			name:     "quoted values",
+			config:   map[string]any{"password": `it's\secret`},
+			expected: defaults + ` password='it\'s\\secret'`,
+		},
+		{
+			name:     "url dsn",
+			config:   map[string]any{"dsn": "postgres://sync@db:5432/app?sslmode=require"},
+			expected: "postgres://sync@db:5432/app?application_name=PgSync_Listener&pool_max_conns=5&pool_min_conns=2&sslmode=require",
+		},
+		{
+			name:     "url dsn defining a default",
+			config:   map[string]any{"dsn": "postgresql://db/app?application_name=custom"},
+			expected: "postgresql://db/app?application_name=custom&pool_max_conns=5&pool_min_conns=2",
+		},
+		{
+			name: "explicit keys override url dsn",
+			config: map[string]any{
+				"dsn":      "postgres://sync@db/app?sslmode=disable",
+				"sslmode":  "verify-full",
+				"password": "p@ss word",
+				"params":   map[string]any{"application_name": "indexer"},
+			},
+			expected: "postgres://sync@db/app?application_name=indexer&password=p%40ss+word&pool_max_conns=5&pool_min_conns=2&sslmode=verify-full",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connString, err := getConnString(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if connString != test.expected {
+				t.Errorf("got %s, expected %s", connString, test.expected)
+			}
+		})
+	}
+
+	if _, err := getConnString(map[string]any{"dsn": "postgres://db:port/app"}); err == nil {
+		t.Error("expected an error for an invalid url dsn")
+	}
+}
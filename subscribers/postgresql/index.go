@@ -1,6 +1,7 @@
 package postgresql
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/quix-labs/pg-el-sync/internals/types"
 	"strings"
@@ -8,30 +9,43 @@ import (
 
 type Index types.Index
 
-func (index *Index) GetSelectQuery() string {
+const IndexAlias = "index"
+
+func (index *Index) GetSelectQuery(staged stagedTables) string {
 	additionalFields := map[string]string{}
 	var leftJoins []string
 
 	for _, relation := range index.Relations {
 		rel := Relation(*relation)
 
-		leftJoins = append(leftJoins, rel.GetLeftJoinQuery(index.Table))
+		leftJoins = append(leftJoins, rel.GetLeftJoinQuery(IndexAlias, staged))
 		additionalFields[relation.Name] = rel.GetLeftJoinField()
 	}
 
 	fields := Fields(index.Fields)
 	query := fmt.Sprintf(
-		`SELECT %s AS "result", "%s"."%s" AS "reference" FROM "%s" %s`,
-		fields.asJsonBuildObjectQuery(index.Table, additionalFields),
-		index.Table,
-		index.ReferenceField,
-		index.Table,
+		`SELECT %s AS "result", %s AS "reference" FROM %s AS "%s" %s`,
+		fields.asJsonBuildObjectQuery(IndexAlias, additionalFields),
+		index.getReferenceSql(IndexAlias, false),
+		quoteTable(index.Schema, index.Table),
+		IndexAlias,
 		strings.Join(leftJoins, " "),
 	)
 	return query
 }
 
-func (index *Index) GetWhereRelationQuery(relationUpdates types.RelationsUpdate) string {
+func (index *Index) GetReferencesQuery() string {
+	wheres := Wheres(index.Wheres)
+	return fmt.Sprintf(
+		`SELECT %s AS "reference" FROM %s AS "%s" %s`,
+		index.getReferenceSql(IndexAlias, false),
+		quoteTable(index.Schema, index.Table),
+		IndexAlias,
+		wheres.GetWhereSql(IndexAlias),
+	)
+}
+
+func (index *Index) GetWhereRelationQuery(relationUpdates types.RelationsUpdate, args *queryArgs) string {
 	var relationSelects []string
 
 	//Split pivot and direct column
@@ -40,15 +54,65 @@ func (index *Index) GetWhereRelationQuery(relationUpdates types.RelationsUpdate)
 		if rel.Parent == nil {
 			var referencesRaw []string
 			for _, reference := range references {
-				referencesRaw = append(referencesRaw, `'`+reference.Reference+`'`)
+				referencesRaw = append(referencesRaw, reference.Reference)
 			}
 			relationSelects = append(relationSelects, fmt.Sprintf(
-				`"%s"."%s"::TEXT IN (%s)`,
-				index.Table, rel.ForeignKey.Parent, strings.Join(referencesRaw, ","),
+				`"%s"."%s" = ANY(%s)`,
+				IndexAlias, rel.ForeignKey.Parent, args.add(textArray(referencesRaw)),
 			))
 		} else {
-			relationSelects = append(relationSelects, "EXISTS ("+rel.GetReverseSelectQuery(index.Table, references, "")+")")
+			relationSelects = append(relationSelects, "EXISTS ("+rel.GetReverseSelectQuery(IndexAlias, references, "", args)+")")
 		}
 	}
 	return "WHERE ( " + strings.Join(relationSelects, " OR ") + ")"
 }
+
+func (index *Index) getReferenceSql(table string, stripQuote bool) string {
+	if !stripQuote {
+		table = `"` + table + `"`
+	}
+	if len(index.ReferenceFields) == 1 {
+		return fmt.Sprintf(`%s."%s"`, table, index.ReferenceFields[0])
+	}
+	var values []string
+	for _, field := range index.ReferenceFields {
+		values = append(values, fmt.Sprintf(`%s."%s"::TEXT`, table, field))
+	}
+	return "json_build_array(" + strings.Join(values, ",") + ")::TEXT"
+}
+
+func (index *Index) getReferencesFilter(references []string, args *queryArgs) string {
+	if len(index.ReferenceFields) == 1 {
+		return fmt.Sprintf(`"%s"."%s" = ANY(%s)`, IndexAlias, index.ReferenceFields[0], args.add(textArray(references)))
+	}
+
+	var columns, recordColumns []string
+	for _, field := range index.ReferenceFields {
+		columns = append(columns, fmt.Sprintf(`"%s"."%s"`, IndexAlias, field))
+		recordColumns = append(recordColumns, fmt.Sprintf(`"record"."%s"`, field))
+	}
+	var records []map[string]string
+	for _, reference := range references {
+		values := types.DecodeReference(reference, len(index.ReferenceFields))
+		if values == nil {
+			continue
+		}
+		record := map[string]string{}
+		for i, field := range index.ReferenceFields {
+			record[field] = values[i]
+		}
+		records = append(records, record)
+	}
+	recordsJson, _ := json.Marshal(records)
+	return fmt.Sprintf(
+		`(%s) IN (SELECT %s FROM json_populate_recordset(NULL::%s, %s::JSON) AS "record")`,
+		strings.Join(columns, ", "),
+		strings.Join(recordColumns, ", "),
+		quoteTable(index.Schema, index.Table),
+		args.add(string(recordsJson)),
+	)
+}
+
+func (index *Index) getKeyset() keyset {
+	return keyset{Table: IndexAlias, Columns: index.ReferenceFields}
+}
@@ -3,111 +3,371 @@ package postgresql
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/quix-labs/pg-el-sync/internals/types"
 	"github.com/quix-labs/pg-el-sync/internals/utils"
 	"github.com/quix-labs/pg-el-sync/subscribers"
-	"os"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	ApplicationName             = "PgSync_Listener"
-	PoolMinConn                 = 2
-	PoolMaxConn                 = 5
-	EventName                   = "pgsync_event"
-	NotifyTriggerFunctionPrefix = "pgsync_trigger"
-	MaxRelationsFilter          = 50
-	SchemaName                  = "pgsync"
+	ApplicationName              = "PgSync_Listener"
+	PoolMinConn                  = 2
+	PoolMaxConn                  = 5
+	DefaultNotifyChannel         = "pgsync_event"
+	NotifyTriggerFunctionPrefix  = "pgsync_trigger"
+	MaxRelationsFilter           = 50
+	DefaultSchemaName            = "pgsync"
+	OutboxTableName              = "events"
+	OutboxBatchSize              = 500
+	OutboxPollInterval           = time.Second * 5
+	OutboxAckInterval            = time.Second
+	OutboxMaxInFlight            = 10000
+	OutboxRescanInterval         = time.Minute // Rows committed out of id order are read at least this often
+	OverflowTableName            = "overflow_payloads"
+	OverflowRetention            = time.Hour // Overflow payloads never acknowledged are deleted after this delay
+	CheckpointTableName          = "checkpoints"
+	MaxNotifyPayloadSize         = 8000 // pg_notify rejects payloads of this size or more
+	QueueMonitorInterval         = time.Second * 30
+	DefaultQueueWarningThreshold = 0.5
+	DefaultMaxReadLag            = time.Second * 5
+	ReadLagPollInterval          = time.Millisecond * 100
+	ReadLagCooldown              = time.Second * 30 // Reads stay on the primary this long once the replica lagged
+	ReconnectMinDelay            = time.Second
+	ReconnectMaxDelay            = time.Minute * 2
+	DefaultThrottleCheckInterval = time.Second * 5
+)
+
+const (
+	TriggerLevelRow       = "row"                    // One notification per row
+	TriggerLevelStatement = "statement"              // One notification per statement and batch of rows, using transition tables
+	StatementBatchBytes   = MaxNotifyPayloadSize / 2 // Leaves room for the last row of a batch and the payload envelope
+)
+
+const (
+	ModeNotify = "notify" // Triggers send the payload with pg_notify, events are lost while not listening
+	ModeOutbox = "outbox" // Triggers insert the payload into the outbox table, pg_notify is only a wake-up signal
 )
 
 type Subscriber struct {
 	subscribers.Subscriber
-	conn *pgxpool.Pool
+	conn         *pgxpool.Pool
+	connConfig   *pgxpool.Config
+	readConn     *pgxpool.Pool // Optional replica fetching documents, nil to use conn
+	readConfig   *pgxpool.Config
+	MaxReadLag   time.Duration
+	readLock     sync.Mutex
+	readReplayed LSN       // Last replay position read from the replica
+	readLagging  time.Time // Documents are read from the primary until then, as the replica lagged
+	Mode         string
+	TriggerLevel string
+
+	Schema                string // Holds trigger functions, views and outbox, also prefix trigger names on user tables
+	NotifyChannel         string
+	DropSchema            bool // Drop the schema with every object depending on it at startup
+	ManageTriggers        bool
+	QueueWarningThreshold float64
+	Throttle              Throttle // Full reindex pauses and timeout
+
+	indices []*types.Index // Listened indices, reindexed after a reconnection
+
+	listening       chan struct{} // Closed once notifications are received
+	listeningOnce   sync.Once
+	snapshotLock    sync.Mutex
+	snapshot        string          // Exported snapshot used to build reindex views
+	snapshotReplica bool            // The snapshot was exported on the replica
+	snapshotPending map[string]bool // Indices not staged from the snapshot yet
+	snapshotRelease func()
+
+	outboxLock      sync.Mutex
+	outboxInFlight  map[int64]bool // Dispatched rows not deleted yet
+	outboxAcked     utils.ConcurrentSlice[int64]
+	outboxCursor    int64 // Last row read, only used by the listen loop
+	outboxRewind    bool  // Read again from the start on the next dispatch
+	outboxRewoundAt time.Time
+}
+
+type notificationPayload struct {
+	Type           string `json:"type"`
+	Id             int64  `json:"id"` // Overflow row holding the real payload when Type is "overflow"
+	Pivot          bool   `json:"pivot"`
+	Index          string `json:"index"`
+	Relation       string `json:"relation"`
+	Action         string `json:"action"`
+	Reference      string `json:"reference"`
+	OldReference   string `json:"old_reference"`
+	SoftDeleted    bool   `json:"soft_deleted"`
+	OldSoftDeleted bool   `json:"old_soft_deleted"`
+	Local          string `json:"local"`
+	OldLocal       string `json:"old_local"`
+	Related        string `json:"related"`
+	OldRelated     string `json:"old_related"`
+
+	// Statement level triggers
+	Rows       []notificationPayload `json:"rows"`
+	References []string              `json:"references"`
 }
 
 func (pg *Subscriber) Init(config map[string]any) {
-	connConf, err := pgxpool.ParseConfig("")
+	pg.listening = make(chan struct{})
+	connString, err := getConnString(config)
+	if err != nil {
+		pg.Logger.Fatal().Err(err).Msg("Invalid connection configuration")
+	}
+	connConf, err := pgxpool.ParseConfig(connString)
 	if err != nil {
-		pg.Logger.Fatal().Err(err)
+		pg.Logger.Fatal().Err(err).Msg("Invalid connection configuration")
 	}
-	connConf.ConnConfig.Config.RuntimeParams["application_name"] = ApplicationName
-	connConf.MinConns = PoolMinConn
-	connConf.MaxConns = PoolMaxConn
-	_ = utils.ParseMapKey(config, "host", &connConf.ConnConfig.Config.Host)
-	_ = utils.ParseMapKey(config, "port", &connConf.ConnConfig.Config.Port)
-	_ = utils.ParseMapKey(config, "database", &connConf.ConnConfig.Config.Database)
-	_ = utils.ParseMapKey(config, "username", &connConf.ConnConfig.Config.User)
-	_ = utils.ParseMapKey(config, "password", &connConf.ConnConfig.Config.Password)
 
-	if pg.conn, err = pgxpool.NewWithConfig(context.TODO(), connConf); err != nil {
-		pg.Logger.Fatal().Err(err).Msgf("Unable to connect to database: %v", err)
+	err = utils.ParseMapKey(config, "mode", &pg.Mode)
+	if err != nil || pg.Mode == "" {
+		pg.Mode = ModeNotify
 	}
-	_, err = pg.conn.Exec(context.Background(), fmt.Sprintf(`DROP SCHEMA IF EXISTS "%s" CASCADE; CREATE SCHEMA "%s"`, SchemaName, SchemaName))
+	if pg.Mode != ModeNotify && pg.Mode != ModeOutbox {
+		pg.Logger.Fatal().Msgf("Invalid mode %s, expected %s or %s", pg.Mode, ModeNotify, ModeOutbox)
+	}
+
+	err = utils.ParseMapKey(config, "trigger_level", &pg.TriggerLevel)
+	if err != nil || pg.TriggerLevel == "" {
+		pg.TriggerLevel = TriggerLevelRow
+	}
+	if pg.TriggerLevel != TriggerLevelRow && pg.TriggerLevel != TriggerLevelStatement {
+		pg.Logger.Fatal().Msgf("Invalid trigger_level %s, expected %s or %s", pg.TriggerLevel, TriggerLevelRow, TriggerLevelStatement)
+	}
+
+	err = utils.ParseMapKey(config, "schema", &pg.Schema)
+	if err != nil || pg.Schema == "" {
+		pg.Schema = DefaultSchemaName
+	}
+	err = utils.ParseMapKey(config, "channel", &pg.NotifyChannel)
+	if err != nil || pg.NotifyChannel == "" {
+		pg.NotifyChannel = DefaultNotifyChannel
+	}
+	err = utils.ParseMapKey(config, "drop_schema", &pg.DropSchema)
 	if err != nil {
-		pg.Logger.Fatal().Err(err).Msg("Error create schema")
+		pg.DropSchema = false
+	}
+	err = utils.ParseMapKey(config, "queue_warning_threshold", &pg.QueueWarningThreshold)
+	if err != nil || pg.QueueWarningThreshold <= 0 {
+		pg.QueueWarningThreshold = DefaultQueueWarningThreshold
+	}
+	err = utils.ParseMapKey(config, "manage_triggers", &pg.ManageTriggers)
+	if err != nil {
+		pg.ManageTriggers = true
+	}
+	pg.initThrottle(config)
+
+	pg.connConfig = connConf
+	if pg.conn, err = pgxpool.NewWithConfig(context.TODO(), connConf); err != nil {
+		pg.Logger.Fatal().Err(err).Msgf("Unable to connect to database: %v", err)
 	}
-	pg.Logger.Printf("Successfully connected to %s@%s/%s", config["username"], config["host"], config["database"])
+	pg.initReadConn(config)
+	pg.Logger.Printf("Successfully connected to %s@%s/%s", connConf.ConnConfig.User, connConf.ConnConfig.Host, connConf.ConnConfig.Database)
 }
 
-func (pg *Subscriber) Listen() {
-	persistentConn, err := pg.conn.Acquire(context.Background())
+func (pg *Subscriber) Install() {
+	if !pg.ManageTriggers {
+		return
+	}
+	var err error
+	if pg.DropSchema {
+		// Also drops triggers installed on user tables, as they depend on the schema functions
+		_, err = pg.conn.Exec(context.Background(), fmt.Sprintf(`DROP SCHEMA IF EXISTS "%s" CASCADE`, pg.Schema))
+		if err != nil {
+			pg.Logger.Fatal().Err(err).Msg("Error drop schema")
+		}
+		pg.Logger.Printf("Schema %s dropped", pg.Schema)
+	}
+	_, err = pg.conn.Exec(context.Background(), fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s"`, pg.Schema))
 	if err != nil {
-		pg.Logger.Printf("Cannot get listen connection: %s", err)
+		pg.Logger.Fatal().Err(err).Msg("Error create schema")
+	}
+	if pg.Mode == ModeOutbox {
+		_, err = pg.conn.Exec(context.Background(), pg.getOutboxTableSql())
+		if err != nil {
+			pg.Logger.Fatal().Err(err).Msg("Error create outbox table")
+		}
+	} else {
+		_, err = pg.conn.Exec(context.Background(), pg.getOverflowTableSql())
+		if err != nil {
+			pg.Logger.Fatal().Err(err).Msg("Error create overflow table")
+		}
 	}
-	listenConn := persistentConn.Conn()
-	_, err = listenConn.Exec(context.Background(), "listen "+EventName)
+	_, err = pg.conn.Exec(context.Background(), pg.getCheckpointTableSql())
 	if err != nil {
-		pg.Logger.Fatal().Err(err).Msgf("Error listening to channel: %s", err)
+		pg.Logger.Fatal().Err(err).Msg("Error create checkpoint table")
 	}
+}
 
+func (pg *Subscriber) Listen() {
+	if pg.Mode == ModeOutbox {
+		pg.listenOutbox()
+		return
+	}
+	go pg.monitorNotificationQueue()
+	listenConn := pg.acquireListenConn()
 	for {
-		notification, err := listenConn.WaitForNotification(context.Background())
+		notification, err := listenConn.Conn().WaitForNotification(context.Background())
 		if err != nil {
-			pg.Logger.Fatal().Err(err).Msgf("Error waiting for notification: %s", err)
+			pg.Logger.Printf("Error waiting for notification: %s", err)
+			listenConn = pg.reacquireListenConn(listenConn)
+			// Notifications sent while disconnected are lost
+			pg.requestCatchUp()
+			continue
 		}
-		event, err := pg.parseNotification(notification)
+		events, err := pg.parseNotification(notification)
 		if err != nil {
 			pg.Logger.Print(err)
 			continue
 		}
-		pg.DispatchEvent(event)
+		for _, event := range events {
+			pg.DispatchEvent(event)
+		}
+	}
+}
+
+func (pg *Subscriber) acquireListenConn() *pgxpool.Conn {
+	delay := ReconnectMinDelay
+	for {
+		conn, err := pg.conn.Acquire(context.Background())
+		if err == nil {
+			_, err = conn.Exec(context.Background(), `LISTEN "`+pg.NotifyChannel+`"`)
+			if err == nil {
+				pg.markListening()
+				return conn
+			}
+			pg.releaseBrokenConn(conn)
+		}
+		pg.Logger.Printf("Cannot listen to channel %s: %s, retrying in %s", pg.NotifyChannel, err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, ReconnectMaxDelay)
 	}
 }
 
-func (pg *Subscriber) parseNotification(notification *pgconn.Notification) (*interface{}, error) {
-	var res struct {
-		Type           string `json:"type"`
-		Index          string `json:"index"`
-		Relation       string `json:"relation"`
-		Action         string `json:"action"`
-		Reference      string `json:"reference"`
-		OldReference   string `json:"old_reference"`
-		SoftDeleted    bool   `json:"soft_deleted"`
-		OldSoftDeleted bool   `json:"old_soft_deleted"`
-		Local          string `json:"local"`
-		OldLocal       string `json:"old_local"`
-		Related        string `json:"related"`
-		OldRelated     string `json:"old_related"`
+func (pg *Subscriber) reacquireListenConn(conn *pgxpool.Conn) *pgxpool.Conn {
+	pg.releaseBrokenConn(conn)
+	conn = pg.acquireListenConn()
+	pg.Logger.Printf("Listening to channel %s again", pg.NotifyChannel)
+	return conn
+}
+
+// releaseBrokenConn close the connection so the pool destroys it instead of reusing it
+func (pg *Subscriber) releaseBrokenConn(conn *pgxpool.Conn) {
+	_ = conn.Conn().Close(context.Background())
+	conn.Release()
+}
+
+func (pg *Subscriber) requestCatchUp() {
+	for _, index := range pg.indices {
+		pg.Logger.Printf("Requesting catch-up reindex of %s", index.Name)
+		var event interface{} = types.ReindexEvent{Index: index.Name}
+		pg.DispatchEvent(&event)
 	}
+}
+
+func (pg *Subscriber) parseNotification(notification *pgconn.Notification) ([]*interface{}, error) {
+	var res notificationPayload
 	err := json.Unmarshal([]byte(notification.Payload), &res)
 	if err != nil {
 		return nil, err
 	}
+	if res.Type == "overflow" {
+		return pg.parseOverflowPayload(res.Id)
+	}
+	return pg.parsePayloads(&res, types.Acknowledgement{})
+}
+
+func (pg *Subscriber) parsePayloads(res *notificationPayload, ack types.Acknowledgement) ([]*interface{}, error) {
+	var payloads []*notificationPayload
+	switch res.Type {
+	case "table_batch":
+		for i := range res.Rows {
+			row := &res.Rows[i]
+			row.Type, row.Index = "table", res.Index
+			payloads = append(payloads, row)
+		}
+	case "relation_batch":
+		payloadType := "relation"
+		if res.Pivot {
+			payloadType = "relation_pivot"
+		}
+		for _, reference := range res.References {
+			payloads = append(payloads, &notificationPayload{
+				Type:      payloadType,
+				Index:     res.Index,
+				Relation:  res.Relation,
+				Reference: reference,
+				Local:     reference,
+			})
+		}
+	default:
+		event, err := pg.parsePayload(res, ack)
+		if err != nil {
+			return nil, err
+		}
+		return []*interface{}{event}, nil
+	}
+
+	ack = countdownAck(len(payloads), ack)
+	var events []*interface{}
+	for _, payload := range payloads {
+		event, err := pg.parsePayload(payload, ack)
+		if err != nil {
+			pg.Logger.Print(err)
+			ack.Acknowledge()
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func countdownAck(count int, ack types.Acknowledgement) types.Acknowledgement {
+	if ack.Ack == nil && ack.Nack == nil {
+		return ack
+	}
+	if count == 0 {
+		ack.Acknowledge()
+		return types.Acknowledgement{}
+	}
+	var remaining atomic.Int64
+	remaining.Store(int64(count))
+	var rejected atomic.Bool
+	return types.Acknowledgement{
+		Ack: func() {
+			if remaining.Add(-1) == 0 && !rejected.Load() {
+				ack.Acknowledge()
+			}
+		},
+		Nack: func() {
+			if rejected.CompareAndSwap(false, true) {
+				ack.Reject()
+			}
+		},
+	}
+}
+
+func (pg *Subscriber) parsePayload(res *notificationPayload, acknowledgement types.Acknowledgement) (*interface{}, error) {
 	var event interface{}
 
 	if res.Type == "table" {
 		switch res.Action {
 		case "insert":
 			event = types.InsertEvent{
-				Index:     res.Index,
-				Reference: res.Reference,
+				Acknowledgement: acknowledgement,
+				Index:           res.Index,
+				Reference:       res.Reference,
 			}
 		case "update":
 			event = types.UpdateEvent{
+				Acknowledgement:       acknowledgement,
 				Index:                 res.Index,
 				Reference:             res.Reference,
 				OldReference:          res.OldReference,
@@ -116,8 +376,9 @@ func (pg *Subscriber) parseNotification(notification *pgconn.Notification) (*int
 			}
 		case "delete":
 			event = types.DeleteEvent{
-				Index:     res.Index,
-				Reference: res.Reference,
+				Acknowledgement: acknowledgement,
+				Index:           res.Index,
+				Reference:       res.Reference,
 			}
 		default:
 			return nil, fmt.Errorf("unable to parse event with action: %s ", res.Action)
@@ -127,25 +388,28 @@ func (pg *Subscriber) parseNotification(notification *pgconn.Notification) (*int
 
 	if res.Type == "relation" {
 		event = types.RelationUpdateEvent{
-			Index:     res.Index,
-			Relation:  res.Relation,
-			Reference: res.Reference,
+			Acknowledgement: acknowledgement,
+			Index:           res.Index,
+			Relation:        res.Relation,
+			Reference:       res.Reference,
 		}
 		return &event, nil
 	}
 	if res.Type == "relation_pivot" {
 		event = types.RelationUpdateEvent{
-			Index:     res.Index,
-			Relation:  res.Relation,
-			Reference: res.Local,
-			Pivot:     true,
+			Acknowledgement: acknowledgement,
+			Index:           res.Index,
+			Relation:        res.Relation,
+			Reference:       res.Local,
+			Pivot:           true,
 		}
 		if res.OldRelated != "" && res.OldRelated != res.Related {
 			event = types.RelationUpdateEvent{
-				Index:     res.Index,
-				Relation:  res.Relation,
-				Reference: res.OldLocal,
-				Pivot:     true,
+				Acknowledgement: acknowledgement,
+				Index:           res.Index,
+				Relation:        res.Relation,
+				Reference:       res.OldLocal,
+				Pivot:           true,
 			}
 		}
 		return &event, nil
@@ -155,197 +419,190 @@ func (pg *Subscriber) parseNotification(notification *pgconn.Notification) (*int
 }
 
 func (pg *Subscriber) Terminate() {
+	if pg.readConn != nil {
+		defer pg.readConn.Close()
+	}
 	defer pg.conn.Close()
 }
 
 // -----------------------------------------------PREPARATION------------------------------------------------
 
 func (pg *Subscriber) PrepareListen(indices []*types.Index) {
-	for _, index := range indices {
-		pg.initIndexListener(index)
-		for _, relation := range index.GetAllRelations() {
-			pg.initRelationListener(relation, index)
+	pg.indices = indices
+	triggers := pg.getTriggers(indices)
+	if !pg.ManageTriggers {
+		err := pg.verifyTriggers(triggers)
+		if err != nil {
+			pg.Logger.Fatal().Err(err).Msg("Triggers are not installed as expected, apply the exported migration")
 		}
+		return
 	}
-}
-
-func (pg *Subscriber) initIndexListener(index *types.Index) {
-	whereOkSql, oldWhereOkSql := "true", "true"
-	if len(index.Wheres) > 0 {
-		wheres := Wheres(index.Wheres)
-		whereOkSql = "(" + wheres.GetConditionSql("NEW", true) + ")"
-		oldWhereOkSql = "(" + wheres.GetConditionSql("OLD", true) + ")"
-	}
-	functionName := NotifyTriggerFunctionPrefix + "_" + index.Table
-	_, err := pg.conn.Exec(context.Background(), fmt.Sprintf(`
-CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
-BEGIN
-  IF TG_OP <> 'UPDATE' OR NEW IS DISTINCT FROM OLD THEN
-    PERFORM pg_notify('%s', json_build_object(
-		'type', 'table',
-		'index', '%s',
-        'action', LOWER(TG_OP),
-        'reference',COALESCE(NEW."%s", OLD."%s")::TEXT,
-        'old_reference',OLD."%s"::TEXT,
-        'soft_deleted',NOT (%s),
-        'old_soft_deleted',NOT (%s)
-    )::TEXT);
-  END IF;
-  RETURN COALESCE(NEW, OLD);
-END;
-$trigger$ LANGUAGE plpgsql VOLATILE;
-`, SchemaName, functionName, EventName, index.Name, index.ReferenceField, index.ReferenceField, index.ReferenceField, whereOkSql, oldWhereOkSql))
-	if err != nil {
-		pg.Logger.Printf("Error create trigger function: %v\n", err)
-		os.Exit(1)
-	}
-	triggerName := "pgsync" + index.Table + "_trigger"
-	sql := fmt.Sprintf(
-		`CREATE OR REPLACE TRIGGER %s AFTER DELETE OR UPDATE OR INSERT ON %s FOR EACH ROW EXECUTE PROCEDURE "%s"."%s"();`,
-		triggerName,
-		index.Table,
-		SchemaName,
-		functionName,
-	)
-	_, err = pg.conn.Exec(context.Background(), sql)
-	if err != nil {
-		pg.Logger.Fatal().Msgf("Error create trigger: %v", err)
+	for _, trigger := range triggers {
+		_, err := pg.conn.Exec(context.Background(), trigger.getFunctionSql(pg.Schema))
+		if err != nil {
+			pg.Logger.Fatal().Msgf("Error create trigger function: %v", err)
+		}
+		for _, sql := range trigger.getDropObsoleteSql() {
+			_, err = pg.conn.Exec(context.Background(), sql)
+			if err != nil {
+				pg.Logger.Fatal().Msgf("Error drop obsolete trigger: %v", err)
+			}
+		}
+		_, err = pg.conn.Exec(context.Background(), trigger.getTriggerSql(pg.Schema))
+		if err != nil {
+			pg.Logger.Fatal().Msgf("Error create trigger: %v", err)
+		}
 	}
 }
-func (pg *Subscriber) initRelationListener(relation *types.Relation, index *types.Index) {
-	functionName := NotifyTriggerFunctionPrefix + "_" + index.Name + "_rel_" + relation.UniqueName
-	_, err := pg.conn.Exec(context.Background(), fmt.Sprintf(`
-CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
-BEGIN
-  IF (TG_OP <> 'UPDATE' OR NEW IS DISTINCT FROM OLD) AND COALESCE(NEW."%s",OLD."%s") IS NOT NULL THEN
-    PERFORM pg_notify('%s', json_build_object(
-		'type', 'relation',
-        'index', '%s',
-        'relation','%s',
-        'reference',COALESCE(NEW."%s", OLD."%s")::TEXT
-    )::TEXT);
-  END IF;
-  RETURN COALESCE(NEW, OLD);
-END;
-$trigger$ LANGUAGE plpgsql VOLATILE;
-`, SchemaName, functionName, relation.ForeignKey.Local, relation.ForeignKey.Local, EventName, index.Name, relation.UniqueName, relation.ForeignKey.Local, relation.ForeignKey.Local))
-	if err != nil {
-		pg.Logger.Fatal().Msgf("Error create trigger function: %v", err)
-	}
-	triggerName := "pgsync_rel_" + index.Name + "_" + relation.UniqueName
-	sql := fmt.Sprintf(
-		`CREATE OR REPLACE TRIGGER %s AFTER DELETE OR UPDATE OR INSERT ON %s FOR EACH ROW EXECUTE PROCEDURE "%s"."%s"();`,
-		triggerName,
-		relation.Table,
-		SchemaName,
-		functionName,
-	)
-	_, err = pg.conn.Exec(context.Background(), sql)
-	if err != nil {
-		pg.Logger.Fatal().Msgf("Error create trigger: %v", err)
+
+func (pg *Subscriber) GetInstallStatements(indices []*types.Index) []string {
+	statements := []string{fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s"`, pg.Schema)}
+	if pg.Mode == ModeOutbox {
+		statements = append(statements, pg.getOutboxTableSql())
+	} else {
+		statements = append(statements, pg.getOverflowTableSql())
 	}
-	if relation.Type == "many_to_many" {
-		pg.initPivotRelationListener(relation, index)
+	statements = append(statements, pg.getCheckpointTableSql())
+	for _, trigger := range pg.getTriggers(indices) {
+		statements = append(statements, trigger.getInstallSql(pg.Schema)...)
 	}
+	return statements
 }
 
-func (pg *Subscriber) initPivotRelationListener(relation *types.Relation, index *types.Index) {
-	functionName := NotifyTriggerFunctionPrefix + "_" + index.Name + "_rel_pivot_" + relation.UniqueName
-	_, err := pg.conn.Exec(context.Background(), fmt.Sprintf(`
-CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
-BEGIN
-  IF TG_OP <> 'UPDATE' OR NEW IS DISTINCT FROM OLD THEN
-    PERFORM pg_notify('%s', json_build_object(
-		'type', 'relation_pivot',
-        'index', '%s',
-        'relation','%s',
-        'local',COALESCE(NEW."%s", null)::TEXT,
-        'old_local',COALESCE(OLD."%s", null)::TEXT,
-        'related',COALESCE(NEW."%s", null)::TEXT,
-        'old_related',COALESCE(OLD."%s", null)::TEXT
-    )::TEXT);
-  END IF;
-  RETURN COALESCE(NEW, OLD);
-END;
-$trigger$ LANGUAGE plpgsql VOLATILE;
-`, SchemaName, functionName, EventName, index.Name, relation.UniqueName, relation.ForeignKey.PivotLocal, relation.ForeignKey.PivotLocal, relation.ForeignKey.PivotRelated, relation.ForeignKey.PivotRelated))
-	if err != nil {
-		pg.Logger.Fatal().Msgf("Error create trigger function: %v", err)
-	}
-	triggerName := "pgsync_rel_pivot_" + index.Name + "_" + relation.UniqueName
-	sql := fmt.Sprintf(
-		`CREATE OR REPLACE TRIGGER %s AFTER DELETE OR UPDATE OR INSERT ON %s FOR EACH ROW EXECUTE PROCEDURE "%s"."%s"();`,
-		triggerName,
-		relation.ForeignKey.PivotTable,
-		SchemaName,
-		functionName,
-	)
-	_, err = pg.conn.Exec(context.Background(), sql)
-	if err != nil {
-		pg.Logger.Fatal().Msgf("Error create trigger: %v", err)
-	}
+func (pg *Subscriber) GetNonTransactionalStatements(indices []*types.Index) []string {
+	return nil
 }
 
 //-----------------------------------------READ INDEX/DOCUMENTS---------------------------------------------
 
-func (pg *Subscriber) GetAllRecordsForIndex(index *types.Index) <-chan types.Record {
-	views := index.GetAllRelationsAsView()
-	var keys []string
-	for relName, _ := range views {
-		keys = append(keys, relName)
-	}
-	//@TODO Ordering view between here level and run concurrently
-	for i := len(views) - 1; i >= 0; i-- {
-		//for _, i := range []string{"posts_author_posts", "posts_author", "posts"} {
-		rel := views[keys[i]]
-		r := Relation(*rel)
-		materializedViewName := r.ViewName
-		_, err := pg.conn.Exec(context.TODO(), fmt.Sprintf(`DROP MATERIALIZED VIEW IF EXISTS "%s"."%s"`, SchemaName, materializedViewName))
+func (pg *Subscriber) GetAllRecordsForIndex(index *types.Index, partitions int, mode types.ReindexMode) ([]<-chan types.Record, error) {
+	run, err := pg.newStagingRun()
+	if err != nil {
+		return nil, fmt.Errorf("cannot start staging run: %w", err)
+	}
+
+	// Catch-ups export their own snapshot, after the events they catch up on
+	var shared string
+	var sharedReplica bool
+	if mode != types.ReindexCatchUp {
+		shared, sharedReplica = pg.getSharedSnapshot()
+	}
+
+	var conn *pgxpool.Pool
+	var references string
+	var read pageReader
+	recordsKeyset := keyset{Table: "records", Columns: []string{"reference"}}
+	if pg.readsReindexFromReplica(shared, sharedReplica) {
+		snapshot, err := pg.getReplicaSnapshot(run, shared)
 		if err != nil {
-			pg.Logger.Fatal().Msgf("Error drop materialized view: %v", err)
+			run.cleanup()
+			return nil, fmt.Errorf("cannot export replica snapshot: %w", err)
 		}
-		_, err = pg.conn.Exec(context.TODO(), fmt.Sprintf(`CREATE MATERIALIZED VIEW "%s"."%s" AS(%s)`, SchemaName, materializedViewName, r.GetSelectQuery()))
+		query := pg.getReplicaQuery(index)
+		conn, references = pg.readConn, pg.getReferencesQuery(index)
+		read = func(conditions []string, args queryArgs, checkpoint func(reference string)) <-chan types.Record {
+			return pg.getCursorRecords(snapshot, query, conditions, args, recordsKeyset, index.ChunkSize, checkpoint)
+		}
+	} else {
+		table, err := pg.stageDocuments(run, index, partitions, shared)
 		if err != nil {
-			pg.Logger.Fatal().Msgf("Error create materialized view: %v", err)
+			run.cleanup()
+			return nil, err
+		}
+		if shared != "" {
+			pg.releaseStagedSnapshot(shared, index.Name)
+		}
+		query := "SELECT * FROM " + table + ` AS "records"`
+		conn, references = pg.conn, query
+		read = func(conditions []string, args queryArgs, checkpoint func(reference string)) <-chan types.Record {
+			return pg.getPageRecords(pg.conn, query, conditions, args, recordsKeyset, index.ChunkSize, checkpoint)
 		}
-		rel.ViewCreated = true
 	}
-	//os.Exit(0)
 
-	wheresSqlRaw := pg.GetWhereQuery(index)
-	query := pg.getSelectQuery(index) + " " + wheresSqlRaw
-	//@TODO Clean code
-	materializedViewName := "pgsync_temp_view_" + index.Name
-	_, err := pg.conn.Exec(context.Background(), fmt.Sprintf(`DROP MATERIALIZED VIEW IF EXISTS "%s"."%s"`, SchemaName, materializedViewName))
-	if err != nil {
-		pg.Logger.Fatal().Msgf("Error drop materialized view: %v", err)
+	var checkpoints []checkpoint
+	if mode == types.ReindexResume {
+		checkpoints, err = pg.loadCheckpoints(index.Name)
+		if err != nil {
+			pg.Logger.Printf("Cannot load checkpoints of %s, reindexing from start: %s", index.Name, err)
+		} else if len(checkpoints) == 0 {
+			pg.Logger.Printf("No checkpoint for %s, reindexing from start", index.Name)
+		}
+		for _, c := range checkpoints {
+			pg.reportSkipped(conn, index.Name, references, recordsKeyset, c)
+		}
 	}
-	_, err = pg.conn.Exec(context.Background(), fmt.Sprintf(`CREATE MATERIALIZED VIEW "%s"."%s" AS(%s)`, SchemaName, materializedViewName, query))
+	// Catch-ups leave checkpoints untouched, so an interrupted manual run can still be resumed
+	savePositions := mode != types.ReindexCatchUp
+	if len(checkpoints) == 0 {
+		checkpoints = pg.getCheckpoints(conn, references, recordsKeyset, partitions)
+		if savePositions {
+			err = pg.saveCheckpoints(index.Name, checkpoints)
+			if err != nil {
+				pg.Logger.Printf("Cannot save checkpoints of %s, running without checkpoints: %s", index.Name, err)
+				savePositions = false
+			}
+		}
+	}
+	var savePosition func(partition int, reference string)
+	if savePositions {
+		savePosition = func(partition int, reference string) { run.savePosition(index.Name, partition, reference) }
+	}
+	channels := pg.getPartitionedQueryRecords(recordsKeyset, checkpoints, savePosition, read)
+	return run.cleanupWhenDrained(channels), nil
+}
+
+func (pg *Subscriber) stageDocuments(run *stagingRun, index *types.Index, partitions int, shared string) (string, error) {
+	snapshot, releaseSnapshot, err := run.getSnapshot(shared)
 	if err != nil {
-		pg.Logger.Fatal().Msgf("Error create materialized view: %v", err)
+		return "", fmt.Errorf("cannot export staging snapshot: %w", err)
 	}
+	defer releaseSnapshot()
 
-	query = "SELECT * FROM " + SchemaName + "." + materializedViewName
-	index.ReferenceField = "reference"
-	index.Table = SchemaName + `"."` + materializedViewName //@TODO Clean code
-	return pg.getQueryRecords(query, index, false)
+	levels := getStagingLevels(index.GetAllRelationsAsView())
+	staged := stagedTables{}
+	for _, level := range levels {
+		for _, rel := range level {
+			staged[rel.UniqueName] = run.newTable()
+		}
+	}
+	table := run.newTable()
+	var builds [][]stagingTable
+	for _, level := range levels {
+		var tables []stagingTable
+		for _, view := range level {
+			r := Relation(*view)
+			tables = append(tables, stagingTable{Name: index.Name + "." + view.GetFullName(), Table: staged[r.UniqueName], Query: r.GetSelectQuery(staged)})
+		}
+		builds = append(builds, tables)
+	}
+	query := pg.getSelectQuery(index, staged) + " " + pg.GetWhereQuery(index)
+	builds = append(builds, []stagingTable{{Name: index.Name, Table: table, Query: query}})
 
-	return pg.getQueryRecords(query, index, wheresSqlRaw != "")
+	for _, tables := range builds {
+		err = run.build(snapshot, tables, partitions)
+		if err != nil {
+			return "", fmt.Errorf("cannot create staging table: %w", err)
+		}
+	}
+	err = pg.execStatements("", []string{`CREATE INDEX ON ` + table + ` ("reference")`})
+	if err != nil {
+		return "", fmt.Errorf("cannot index staging table: %w", err)
+	}
+	return table, nil
 }
 func (pg *Subscriber) GetFullRecordsForIndex(references []string, index *types.Index) <-chan types.Record {
 	wheresSqlRaw := pg.GetWhereQuery(index)
-	query := pg.getSelectQuery(index) + " " + wheresSqlRaw
+	query := pg.getSelectQuery(index, nil) + " " + wheresSqlRaw
+	idx := Index(*index)
+	args := queryArgs{}
+	referencesSql := idx.getReferencesFilter(references, &args)
 	if wheresSqlRaw != "" {
-		query += fmt.Sprintf(
-			` AND "%s"."%s" IN (%s)`, index.Table, index.ReferenceField, strings.Join(references, ","),
-		)
+		query += " AND " + referencesSql
 	} else {
-		query += fmt.Sprintf(
-			`WHERE "%s"."%s" IN (%s)`, index.Table, index.ReferenceField, strings.Join(references, ","),
-		)
+		query += "WHERE " + referencesSql
 	}
 
-	return pg.getQueryRecords(query, index, true)
+	return pg.getQueryRecords(pg.getReadConn(), query, args, idx.getKeyset(), index.ChunkSize, true)
 }
 
 func (pg *Subscriber) GetFullRecordsForRelationUpdate(relationUpdates types.RelationsUpdate, idx *types.Index) <-chan types.Record {
@@ -353,20 +610,22 @@ func (pg *Subscriber) GetFullRecordsForRelationUpdate(relationUpdates types.Rela
 
 	go func() {
 		index := Index(*idx)
+		readConn := pg.getReadConn()
 		var getRecords = func(relationUpdates types.RelationsUpdate) {
 			wheresSqlRaw := pg.GetWhereQuery(idx)
-			wheresRelationRaw := index.GetWhereRelationQuery(relationUpdates)
+			args := queryArgs{}
+			wheresRelationRaw := index.GetWhereRelationQuery(relationUpdates, &args)
 
 			sqlQuery := ""
 			if wheresSqlRaw == "" {
-				sqlQuery = index.GetSelectQuery() + " " + wheresRelationRaw
+				sqlQuery = index.GetSelectQuery(nil) + " " + wheresRelationRaw
 			} else {
 				wheresRelationRaw = strings.TrimPrefix(wheresRelationRaw, "WHERE ")
 				wheresRelationRaw = "AND " + wheresRelationRaw
-				sqlQuery = index.GetSelectQuery() + " " + wheresSqlRaw + " " + wheresRelationRaw
+				sqlQuery = index.GetSelectQuery(nil) + " " + wheresSqlRaw + " " + wheresRelationRaw
 			}
 			//fmt.Println(sqlQuery)
-			for row := range pg.getQueryRecords(sqlQuery, idx, true) {
+			for row := range pg.getQueryRecords(readConn, sqlQuery, args, index.getKeyset(), idx.ChunkSize, true) {
 				ch <- row
 			}
 		}
@@ -396,74 +655,199 @@ func (pg *Subscriber) GetFullRecordsForRelationUpdate(relationUpdates types.Rela
 
 // ---------------------------------------------INTERNALS----------------------------------------------------------------
 
+func (pg *Subscriber) getPartitionBounds(conn *pgxpool.Pool, query string, k keyset, partitions int) ([]string, error) {
+	records := keyset{Table: "records", Columns: k.Columns}
+	rows, err := conn.Query(context.Background(), fmt.Sprintf(
+		`SELECT DISTINCT ON ("partitions"."partition") "partitions"."reference" FROM (
+			SELECT %s AS "reference", ntile(%d) OVER (ORDER BY %s) AS "partition", row_number() OVER (ORDER BY %s) AS "position"
+			FROM (%s) AS "records"
+		) AS "partitions" ORDER BY "partitions"."partition", "partitions"."position" DESC`,
+		records.getReferenceSql(), partitions, records.getOrderSql(), records.getOrderSql(), query,
+	))
+	if err != nil {
+		return nil, err
+	}
+	bounds, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil || len(bounds) == 0 {
+		return nil, err
+	}
+	return bounds[:len(bounds)-1], nil
+}
+
+type pageReader func(conditions []string, args queryArgs, checkpoint func(reference string)) <-chan types.Record
+
+func (pg *Subscriber) getPartitionedQueryRecords(keyset keyset, checkpoints []checkpoint, savePosition func(partition int, reference string), read pageReader) []<-chan types.Record {
+	var channels []<-chan types.Record
+	for _, c := range checkpoints {
+		args := queryArgs{}
+		conditions := c.getConditionsSql(keyset, &args)
+		var checkpoint func(reference string)
+		if savePosition != nil {
+			partition := c.Partition
+			checkpoint = func(reference string) { savePosition(partition, reference) }
+		}
+		channels = append(channels, read(conditions, args, checkpoint))
+	}
+	return channels
+}
+
 func (pg *Subscriber) GetConditionQuery(index *types.Index) string {
 	wheres := Wheres(index.Wheres)
-	wheresSqlRaw := wheres.GetConditionSql(index.Table, false)
+	wheresSqlRaw := wheres.GetConditionSql(IndexAlias, false)
 	return wheresSqlRaw
 }
 func (pg *Subscriber) GetWhereQuery(index *types.Index) string {
 	wheres := Wheres(index.Wheres)
-	wheresSqlRaw := wheres.GetWhereSql(index.Table)
+	wheresSqlRaw := wheres.GetWhereSql(IndexAlias)
 	return wheresSqlRaw
 }
-func (pg *Subscriber) getSelectQuery(idx *types.Index) string {
+func (pg *Subscriber) getSelectQuery(idx *types.Index, staged stagedTables) string {
 	index := Index(*idx)
-	query := index.GetSelectQuery()
+	query := index.GetSelectQuery(staged)
 	return query
 }
 
-func (pg *Subscriber) getQueryRecords(query string, index *types.Index, useAnd bool) <-chan types.Record {
+func (pg *Subscriber) getQueryRecords(conn *pgxpool.Pool, query string, args queryArgs, keyset keyset, chunkSize int, useAnd bool) <-chan types.Record {
 	ch := make(chan types.Record)
 	baseQuery := query
 	go func() {
 		defer close(ch)
 
-		prevId := 0
-		rowsCount := index.ChunkSize
-		for rowsCount >= index.ChunkSize {
+		// Keyset pagination on the native reference types
+		var prevReference *string
+		rowsCount := chunkSize
+		for rowsCount >= chunkSize {
 			rowsCount = 0
-			operator := "WHERE"
-			if useAnd {
-				operator = "AND"
+			query := baseQuery
+			pageArgs := append(queryArgs{}, args...)
+			if prevReference != nil {
+				operator := "WHERE"
+				if useAnd {
+					operator = "AND"
+				}
+				query += fmt.Sprintf(` %s %s`, operator, keyset.getAfterSql(*prevReference, &pageArgs))
 			}
-			query := fmt.Sprintf(
-				`%s %s "%s"."%s" > %d ORDER BY "%s" ASC LIMIT %d`,
-				baseQuery,
-				operator,
-				index.Table,
-				index.ReferenceField,
-				prevId,
-				index.ReferenceField,
-				index.ChunkSize,
-			)
-			rows, err := pg.conn.Query(context.Background(), query)
+			query += fmt.Sprintf(` ORDER BY %s LIMIT %d`, keyset.getOrderSql(), chunkSize)
+
+			rows, err := conn.Query(context.Background(), query, pageArgs...)
 			if err != nil {
-				pg.Logger.Printf("Cannot execute query: %s", err)
+				ch <- types.Record{Err: err}
+				return
 			}
 			for rows.Next() {
-				var jsonRowResult []byte
-				var reference int
-				err := rows.Scan(&jsonRowResult, &reference)
-				if err != nil {
-					pg.Logger.Printf("Error fetching row: %s", err)
-					continue
+				rowsCount++
+				record, ok := pg.scanRecord(rows)
+				if record.Reference != "" {
+					prevReference = &record.Reference
 				}
-
-				//Parse DB JSON result
-				var fullRecord map[string]interface{}
-				err = json.Unmarshal(jsonRowResult, &fullRecord)
-				if err != nil {
-					pg.Logger.Printf("Cannot parse json for row: %s", err)
-					continue
+				if ok {
+					ch <- record
 				}
-
-				rowsCount++
-				prevId = reference
-				ch <- types.Record{Reference: strconv.Itoa(reference), Data: fullRecord}
 			}
 			rows.Close()
+			if rows.Err() != nil {
+				ch <- types.Record{Err: rows.Err()}
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// getPageRecords read each page in its own short transaction, so no snapshot is held while publishing
+func (pg *Subscriber) getPageRecords(conn *pgxpool.Pool, query string, conditions []string, args queryArgs, keyset keyset, chunkSize int, checkpoint func(reference string)) <-chan types.Record {
+	ch := make(chan types.Record)
+	go func() {
+		defer close(ch)
+
+		var after *string
+		for {
+			pg.waitForLoad()
+			records, last, err := pg.getPage(conn, query, conditions, args, keyset, after, chunkSize)
+			if err != nil {
+				ch <- types.Record{Err: err}
+				return
+			}
+			for _, record := range records {
+				if checkpoint != nil {
+					reference := record.Reference
+					record.Checkpoint = func() { checkpoint(reference) }
+				}
+				ch <- record
+			}
+			if last == nil {
+				return
+			}
+			after = last
 		}
 	}()
 
 	return ch
 }
+
+func (pg *Subscriber) getPage(conn *pgxpool.Pool, query string, conditions []string, args queryArgs, keyset keyset, after *string, chunkSize int) (records []types.Record, last *string, err error) {
+	tx, err := conn.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(context.Background())
+	err = pg.setStatementTimeout(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pageArgs := append(queryArgs{}, args...)
+	if after != nil {
+		conditions = append(append([]string{}, conditions...), keyset.getAfterSql(*after, &pageArgs))
+	}
+	pageQuery := query
+	if len(conditions) > 0 {
+		pageQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := tx.Query(context.Background(), fmt.Sprintf(`%s ORDER BY %s LIMIT %d`, pageQuery, keyset.getOrderSql(), chunkSize), pageArgs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	count := 0
+	var reference string
+	for rows.Next() {
+		count++
+		record, ok := pg.scanRecord(rows)
+		reference = record.Reference
+		if ok {
+			records = append(records, record)
+		}
+	}
+	if rows.Err() != nil {
+		return nil, nil, rows.Err()
+	}
+	if count < chunkSize {
+		return records, nil, nil
+	}
+	if reference == "" {
+		return nil, nil, errors.New("cannot read the reference of the last row of a page")
+	}
+	return records, &reference, nil
+}
+
+// scanRecord keep the reference when only the document cannot be parsed
+func (pg *Subscriber) scanRecord(rows pgx.Rows) (types.Record, bool) {
+	var jsonRowResult []byte
+	var reference string
+	err := rows.Scan(&jsonRowResult, &reference)
+	if err != nil {
+		pg.Logger.Printf("Error fetching row: %s", err)
+		return types.Record{}, false
+	}
+
+	//Parse DB JSON result
+	var fullRecord map[string]interface{}
+	err = json.Unmarshal(jsonRowResult, &fullRecord)
+	if err != nil {
+		pg.Logger.Printf("Cannot parse json for row: %s", err)
+		return types.Record{Reference: reference}, false
+	}
+	return types.Record{Reference: reference, Data: fullRecord}, true
+}
@@ -0,0 +1,88 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"time"
+)
+
+// getNotifySql store payloads too large for pg_notify in the overflow table and only notify their id
+func (pg *Subscriber) getNotifySql(payloadSql string) string {
+	return fmt.Sprintf(`DECLARE
+      payload TEXT := (%s)::TEXT;
+      overflow_id BIGINT;
+    BEGIN
+      IF octet_length(payload) < %d THEN
+        PERFORM pg_notify('%s', payload);
+      ELSE
+        INSERT INTO "%s"."%s" ("payload") VALUES (payload::JSON) RETURNING "id" INTO overflow_id;
+        PERFORM pg_notify('%s', json_build_object('type', 'overflow', 'id', overflow_id)::TEXT);
+      END IF;
+    END;`,
+		payloadSql, MaxNotifyPayloadSize, pg.NotifyChannel, pg.Schema, OverflowTableName, pg.NotifyChannel,
+	)
+}
+
+func (pg *Subscriber) getOverflowTableSql() string {
+	return fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS "%s"."%s" ("id" BIGSERIAL PRIMARY KEY, "payload" JSON NOT NULL, "created_at" TIMESTAMPTZ NOT NULL DEFAULT now())`,
+		pg.Schema, OverflowTableName,
+	)
+}
+
+func (pg *Subscriber) parseOverflowPayload(id int64) ([]*interface{}, error) {
+	var payload notificationPayload
+	err := pg.conn.QueryRow(context.Background(), fmt.Sprintf(
+		`SELECT "payload" FROM "%s"."%s" WHERE "id" = $1`,
+		pg.Schema, OverflowTableName,
+	), id).Scan(&payload)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load overflow payload %d: %w", id, err)
+	}
+	return pg.parsePayloads(&payload, types.Acknowledgement{Ack: func() {
+		_, err := pg.conn.Exec(context.Background(), fmt.Sprintf(
+			`DELETE FROM "%s"."%s" WHERE "id" = $1`,
+			pg.Schema, OverflowTableName,
+		), id)
+		if err != nil {
+			pg.Logger.Printf("Cannot delete overflow payload %d: %s", id, err)
+		}
+	}})
+}
+
+// monitorNotificationQueue warn before the queue is full, as every transaction firing a trigger then fails at commit
+func (pg *Subscriber) monitorNotificationQueue() {
+	for range time.Tick(QueueMonitorInterval) {
+		pg.deleteExpiredOverflow()
+
+		var usage float64
+		err := pg.conn.QueryRow(context.Background(), `SELECT pg_notification_queue_usage()`).Scan(&usage)
+		if err != nil {
+			pg.Logger.Printf("Cannot read notification queue usage: %s", err)
+			continue
+		}
+		if usage >= pg.QueueWarningThreshold {
+			pg.Logger.Warn().Float64("queue_usage", usage).Msgf(
+				"Notification queue is %.1f%% full, writes will fail once it is full. Consider the outbox mode",
+				usage*100,
+			)
+			continue
+		}
+		pg.Logger.Debug().Float64("queue_usage", usage).Msg("Notification queue usage")
+	}
+}
+
+func (pg *Subscriber) deleteExpiredOverflow() {
+	result, err := pg.conn.Exec(context.Background(), fmt.Sprintf(
+		`DELETE FROM "%s"."%s" WHERE "created_at" < now() - make_interval(secs => $1)`,
+		pg.Schema, OverflowTableName,
+	), OverflowRetention.Seconds())
+	if err != nil {
+		pg.Logger.Printf("Cannot delete expired overflow payloads: %s", err)
+		return
+	}
+	if result.RowsAffected() > 0 {
+		pg.Logger.Printf("%d overflow payloads older than %s deleted", result.RowsAffected(), OverflowRetention)
+	}
+}
@@ -0,0 +1,150 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"time"
+)
+
+func (pg *Subscriber) getEmitSql(payloadSql string) string {
+	if pg.Mode == ModeOutbox {
+		return fmt.Sprintf(
+			`INSERT INTO "%s"."%s" ("payload") VALUES (%s);
+    PERFORM pg_notify('%s', '');`,
+			pg.Schema, OutboxTableName, payloadSql, pg.NotifyChannel,
+		)
+	}
+	return pg.getNotifySql(payloadSql)
+}
+
+func (pg *Subscriber) getOutboxTableSql() string {
+	return fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS "%s"."%s" ("id" BIGSERIAL PRIMARY KEY, "payload" JSON NOT NULL, "created_at" TIMESTAMPTZ NOT NULL DEFAULT now())`,
+		pg.Schema, OutboxTableName,
+	)
+}
+
+// listenOutbox delete rows once acknowledged, unacknowledged rows are dispatched again after a restart
+func (pg *Subscriber) listenOutbox() {
+	pg.outboxInFlight = make(map[int64]bool)
+	go pg.asyncDeleteAcknowledged()
+
+	// Events stay in the outbox while disconnected, no catch-up is needed after reconnecting
+	listenConn := pg.acquireListenConn()
+	for {
+		if pg.dispatchOutbox() >= OutboxBatchSize {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), OutboxPollInterval)
+		_, err := listenConn.Conn().WaitForNotification(ctx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			pg.Logger.Printf("Error waiting for notification: %s", err)
+			listenConn = pg.reacquireListenConn(listenConn)
+		}
+		if ctx.Err() != nil {
+			// Idle: read rows committed after rows with a greater id
+			pg.rewindOutbox()
+		}
+	}
+}
+
+func (pg *Subscriber) dispatchOutbox() int {
+	pg.outboxLock.Lock()
+	if pg.outboxRewind || time.Since(pg.outboxRewoundAt) >= OutboxRescanInterval {
+		pg.outboxCursor = 0
+		pg.outboxRewind = false
+		pg.outboxRewoundAt = time.Now()
+	}
+	limit := min(OutboxBatchSize, OutboxMaxInFlight-len(pg.outboxInFlight))
+	pg.outboxLock.Unlock()
+	if limit <= 0 {
+		return 0
+	}
+
+	rows, err := pg.conn.Query(context.Background(), fmt.Sprintf(
+		`SELECT "id", "payload" FROM "%s"."%s" WHERE "id" > $1 ORDER BY "id" ASC LIMIT %d`,
+		pg.Schema, OutboxTableName, limit,
+	), pg.outboxCursor)
+	if err != nil {
+		pg.Logger.Printf("Cannot read outbox: %s", err)
+		return 0
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var id int64
+		var payload notificationPayload
+		err = rows.Scan(&id, &payload)
+		if err != nil {
+			pg.Logger.Printf("Error fetching outbox row: %s", err)
+			continue
+		}
+		count++
+		pg.outboxCursor = id
+
+		pg.outboxLock.Lock()
+		inFlight := pg.outboxInFlight[id]
+		pg.outboxInFlight[id] = true
+		pg.outboxLock.Unlock()
+		if inFlight {
+			continue
+		}
+		ack := types.Acknowledgement{
+			Ack:  func() { pg.outboxAcked.Append(id) },
+			Nack: func() { pg.rejectOutbox(id) },
+		}
+
+		events, err := pg.parsePayloads(&payload, ack)
+		if err != nil {
+			pg.Logger.Print(err)
+			ack.Acknowledge()
+			continue
+		}
+		for _, event := range events {
+			pg.DispatchEvent(event)
+		}
+	}
+	return count
+}
+
+func (pg *Subscriber) rejectOutbox(id int64) {
+	pg.outboxLock.Lock()
+	defer pg.outboxLock.Unlock()
+	delete(pg.outboxInFlight, id)
+	pg.outboxRewind = true
+}
+
+func (pg *Subscriber) rewindOutbox() {
+	pg.outboxLock.Lock()
+	defer pg.outboxLock.Unlock()
+	pg.outboxRewind = true
+}
+
+func (pg *Subscriber) asyncDeleteAcknowledged() {
+	for range time.Tick(OutboxAckInterval) {
+		if pg.outboxAcked.Len() == 0 {
+			continue
+		}
+		ids := pg.outboxAcked.Retrieve(pg.outboxAcked.Len())
+		_, err := pg.conn.Exec(context.Background(), fmt.Sprintf(
+			`DELETE FROM "%s"."%s" WHERE "id" = ANY($1::BIGINT[])`,
+			pg.Schema, OutboxTableName,
+		), ids)
+		if err != nil {
+			pg.Logger.Printf("Cannot delete acknowledged outbox rows: %s", err)
+			for _, id := range ids {
+				pg.outboxAcked.Append(id)
+			}
+			continue
+		}
+		pg.outboxLock.Lock()
+		for _, id := range ids {
+			delete(pg.outboxInFlight, id)
+		}
+		pg.outboxLock.Unlock()
+	}
+}
@@ -0,0 +1,84 @@
+package postgresql
+
+import (
+	"fmt"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"strings"
+)
+
+// textArray is bound as text, letting the server cast each element to the compared column type
+func textArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		value = strings.ReplaceAll(value, `"`, `\"`)
+		quoted[i] = `"` + value + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+func quoteTable(schema string, table string) string {
+	if schema == "" {
+		return `"` + table + `"`
+	}
+	return `"` + schema + `"."` + table + `"`
+}
+
+type queryArgs []any
+
+func (args *queryArgs) add(value any) string {
+	*args = append(*args, value)
+	return fmt.Sprintf("$%d", len(*args))
+}
+
+type keyset struct {
+	Table   string
+	Columns []string
+}
+
+func (k keyset) getOrderSql() string {
+	var columns []string
+	for _, column := range k.Columns {
+		columns = append(columns, fmt.Sprintf(`"%s"."%s" ASC`, k.Table, column))
+	}
+	return strings.Join(columns, ", ")
+}
+
+// getReferenceSql return the reference of a row, encoded as types.EncodeReference does
+func (k keyset) getReferenceSql() string {
+	var columns []string
+	for _, column := range k.Columns {
+		columns = append(columns, fmt.Sprintf(`"%s"."%s"::TEXT`, k.Table, column))
+	}
+	if len(columns) == 1 {
+		return columns[0]
+	}
+	return "json_build_array(" + strings.Join(columns, ", ") + ")::TEXT"
+}
+
+func (k keyset) getAfterSql(reference string, args *queryArgs) string {
+	return k.getCompareSql(">", reference, args)
+}
+
+func (k keyset) getUpToSql(reference string, args *queryArgs) string {
+	return k.getCompareSql("<=", reference, args)
+}
+
+func (k keyset) getCompareSql(operator string, reference string, args *queryArgs) string {
+	var columns, placeholders []string
+	for i, value := range types.DecodeReference(reference, len(k.Columns)) {
+		columns = append(columns, fmt.Sprintf(`"%s"."%s"`, k.Table, k.Columns[i]))
+		placeholders = append(placeholders, args.add(value))
+	}
+	if len(columns) == 0 {
+		return "FALSE"
+	}
+	if len(columns) == 1 {
+		return columns[0] + " " + operator + " " + placeholders[0]
+	}
+	return "(" + strings.Join(columns, ", ") + ") " + operator + " (" + strings.Join(placeholders, ", ") + ")"
+}
@@ -0,0 +1,232 @@
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Minimal decoder for the streaming replication protocol and the pgoutput plugin (proto_version 1)
+
+type LSN uint64
+
+func (lsn LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+func parseLSN(value string) (LSN, error) {
+	var high, low uint32
+	_, err := fmt.Sscanf(value, "%X/%X", &high, &low)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %s: %w", value, err)
+	}
+	return LSN(uint64(high)<<32 | uint64(low)), nil
+}
+
+var postgresEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type xLogData struct {
+	WALStart LSN
+	WALEnd   LSN
+	Data     []byte
+}
+
+type primaryKeepalive struct {
+	WALEnd         LSN
+	ReplyRequested bool
+}
+
+type pgOutputRelation struct {
+	ID        uint32
+	Namespace string
+	Name      string
+	Columns   []string
+}
+
+// pgOutputTuple maps column names to their text value, unchanged TOASTed columns are absent
+type pgOutputTuple map[string]*string
+
+type pgOutputChange struct {
+	Action   string // 'insert', 'update', 'delete'
+	Relation uint32
+	New      pgOutputTuple
+	Old      pgOutputTuple
+	OldFull  bool // Old contains every column (REPLICA IDENTITY FULL), not only the key
+}
+
+type pgOutputBegin struct{}
+
+type pgOutputCommit struct {
+	EndLSN LSN
+}
+
+type pgOutputReader struct {
+	buf *bytes.Reader
+	err error
+}
+
+func (r *pgOutputReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.buf.ReadByte()
+	r.err = err
+	return b
+}
+func (r *pgOutputReader) int16() int16 {
+	var v int16
+	if r.err == nil {
+		r.err = binary.Read(r.buf, binary.BigEndian, &v)
+	}
+	return v
+}
+func (r *pgOutputReader) int32() int32 {
+	var v int32
+	if r.err == nil {
+		r.err = binary.Read(r.buf, binary.BigEndian, &v)
+	}
+	return v
+}
+func (r *pgOutputReader) int64() int64 {
+	var v int64
+	if r.err == nil {
+		r.err = binary.Read(r.buf, binary.BigEndian, &v)
+	}
+	return v
+}
+func (r *pgOutputReader) string() string {
+	var str []byte
+	for r.err == nil {
+		b := r.byte()
+		if b == 0 {
+			break
+		}
+		str = append(str, b)
+	}
+	return string(str)
+}
+func (r *pgOutputReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > r.buf.Len() {
+		r.err = errors.New("invalid length in pgoutput message")
+		return nil
+	}
+	data := make([]byte, n)
+	_, r.err = r.buf.Read(data)
+	return data
+}
+
+func parseCopyData(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty copy data message")
+	}
+	r := &pgOutputReader{buf: bytes.NewReader(data[1:])}
+	switch data[0] {
+	case 'w':
+		msg := xLogData{WALStart: LSN(r.int64()), WALEnd: LSN(r.int64())}
+		r.int64() // server time
+		msg.Data = r.bytes(r.buf.Len())
+		return msg, r.err
+	case 'k':
+		msg := primaryKeepalive{WALEnd: LSN(r.int64())}
+		r.int64() // server time
+		msg.ReplyRequested = r.byte() == 1
+		return msg, r.err
+	}
+	return nil, fmt.Errorf("unknown copy data message type: %c", data[0])
+}
+
+// parsePgOutput return nil for unsupported messages (origin, type, truncate...)
+func parsePgOutput(data []byte, relations map[uint32]*pgOutputRelation) (any, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty pgoutput message")
+	}
+	r := &pgOutputReader{buf: bytes.NewReader(data[1:])}
+	switch data[0] {
+	case 'R':
+		rel := &pgOutputRelation{ID: uint32(r.int32()), Namespace: r.string(), Name: r.string()}
+		r.byte() // replica identity
+		columnsCount := int(r.int16())
+		for i := 0; i < columnsCount && r.err == nil; i++ {
+			r.byte() // flags
+			rel.Columns = append(rel.Columns, r.string())
+			r.int32() // type oid
+			r.int32() // type modifier
+		}
+		return rel, r.err
+	case 'B':
+		return pgOutputBegin{}, nil
+	case 'C':
+		r.byte()  // flags
+		r.int64() // commit lsn
+		return pgOutputCommit{EndLSN: LSN(r.int64())}, r.err
+	case 'I', 'U', 'D':
+		change := pgOutputChange{Relation: uint32(r.int32())}
+		rel, ok := relations[change.Relation]
+		if !ok {
+			return nil, fmt.Errorf("unknown relation %d in pgoutput message", change.Relation)
+		}
+		switch data[0] {
+		case 'I':
+			change.Action = "insert"
+			r.byte() // 'N'
+			change.New = r.tuple(rel)
+		case 'U':
+			change.Action = "update"
+			kind := r.byte()
+			if kind == 'K' || kind == 'O' {
+				change.OldFull = kind == 'O'
+				change.Old = r.tuple(rel)
+				r.byte() // 'N'
+			}
+			change.New = r.tuple(rel)
+		case 'D':
+			change.Action = "delete"
+			change.OldFull = r.byte() == 'O'
+			change.Old = r.tuple(rel)
+		}
+		return change, r.err
+	}
+	return nil, nil
+}
+
+func (r *pgOutputReader) tuple(rel *pgOutputRelation) pgOutputTuple {
+	tuple := pgOutputTuple{}
+	columnsCount := int(r.int16())
+	for i := 0; i < columnsCount && r.err == nil; i++ {
+		if i >= len(rel.Columns) {
+			r.err = fmt.Errorf("too many columns in tuple for relation %s", rel.Name)
+			break
+		}
+		name := rel.Columns[i]
+		switch r.byte() {
+		case 'n':
+			tuple[name] = nil
+		case 't':
+			value := string(r.bytes(int(r.int32())))
+			tuple[name] = &value
+		case 'u':
+			// Unchanged TOAST value, not sent by the server
+		default:
+			r.err = fmt.Errorf("unsupported tuple data kind for column %s", name)
+		}
+	}
+	return tuple
+}
+
+func encodeStandbyStatus(lsn LSN, replyRequested bool) []byte {
+	buf := make([]byte, 0, 34)
+	buf = append(buf, 'r')
+	buf = binary.BigEndian.AppendUint64(buf, uint64(lsn)) // written
+	buf = binary.BigEndian.AppendUint64(buf, uint64(lsn)) // flushed
+	buf = binary.BigEndian.AppendUint64(buf, uint64(lsn)) // applied
+	buf = binary.BigEndian.AppendUint64(buf, uint64(time.Since(postgresEpoch).Microseconds()))
+	if replyRequested {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
@@ -0,0 +1,216 @@
+package postgresql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+type message struct {
+	bytes.Buffer
+}
+
+func (m *message) byte(b byte) *message {
+	m.WriteByte(b)
+	return m
+}
+func (m *message) int16(v int16) *message {
+	_ = binary.Write(m, binary.BigEndian, v)
+	return m
+}
+func (m *message) int32(v int32) *message {
+	_ = binary.Write(m, binary.BigEndian, v)
+	return m
+}
+func (m *message) int64(v int64) *message {
+	_ = binary.Write(m, binary.BigEndian, v)
+	return m
+}
+func (m *message) string(v string) *message {
+	m.WriteString(v)
+	return m.byte(0)
+}
+func (m *message) text(v string) *message {
+	return m.byte('t').int32(int32(len(v))).append([]byte(v))
+}
+func (m *message) append(data []byte) *message {
+	m.Write(data)
+	return m
+}
+
+func value(v string) *string {
+	return &v
+}
+
+func TestParsePgOutput(t *testing.T) {
+	relations := map[uint32]*pgOutputRelation{
+		16384: {ID: 16384, Namespace: "public", Name: "posts", Columns: []string{"id", "title", "body"}},
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected any
+		err      bool
+	}{
+		{
+			name: "relation",
+			data: new(message).byte('R').int32(16385).string("public").string("users").byte('d').int16(2).
+				byte(1).string("id").int32(23).int32(-1).
+				byte(0).string("name").int32(25).int32(-1).Bytes(),
+			expected: &pgOutputRelation{ID: 16385, Namespace: "public", Name: "users", Columns: []string{"id", "name"}},
+		},
+		{
+			name:     "begin",
+			data:     new(message).byte('B').int64(0x100).int64(0).int32(42).Bytes(),
+			expected: pgOutputBegin{},
+		},
+		{
+			name:     "commit",
+			data:     new(message).byte('C').byte(0).int64(0x100).int64(0x1_0000_0200).int64(0).Bytes(),
+			expected: pgOutputCommit{EndLSN: 0x1_0000_0200},
+		},
+		{
+			name: "insert",
+			data: new(message).byte('I').int32(16384).byte('N').int16(3).
+				text("1").byte('n').text("content").Bytes(),
+			expected: pgOutputChange{Action: "insert", Relation: 16384, New: pgOutputTuple{"id": value("1"), "title": nil, "body": value("content")}},
+		},
+		{
+			name: "update with unchanged toast",
+			data: new(message).byte('U').int32(16384).byte('N').int16(3).
+				text("1").text("title").byte('u').Bytes(),
+			expected: pgOutputChange{Action: "update", Relation: 16384, New: pgOutputTuple{"id": value("1"), "title": value("title")}},
+		},
+		{
+			name: "update of key",
+			data: new(message).byte('U').int32(16384).byte('K').int16(1).text("1").
+				byte('N').int16(3).text("2").text("title").text("content").Bytes(),
+			expected: pgOutputChange{
+				Action: "update", Relation: 16384,
+				Old: pgOutputTuple{"id": value("1")},
+				New: pgOutputTuple{"id": value("2"), "title": value("title"), "body": value("content")},
+			},
+		},
+		{
+			name: "update with full old row",
+			data: new(message).byte('U').int32(16384).byte('O').int16(3).text("1").text("old").byte('n').
+				byte('N').int16(3).text("1").text("new").byte('n').Bytes(),
+			expected: pgOutputChange{
+				Action: "update", Relation: 16384, OldFull: true,
+				Old: pgOutputTuple{"id": value("1"), "title": value("old"), "body": nil},
+				New: pgOutputTuple{"id": value("1"), "title": value("new"), "body": nil},
+			},
+		},
+		{
+			name:     "delete",
+			data:     new(message).byte('D').int32(16384).byte('K').int16(1).text("1").Bytes(),
+			expected: pgOutputChange{Action: "delete", Relation: 16384, Old: pgOutputTuple{"id": value("1")}},
+		},
+		{
+			name:     "unsupported message",
+			data:     new(message).byte('T').int32(1).byte(0).int32(16384).Bytes(),
+			expected: nil,
+		},
+		{name: "empty message", data: nil, err: true},
+		{name: "unknown relation", data: new(message).byte('I').int32(1).byte('N').int16(0).Bytes(), err: true},
+		{name: "too many columns", data: new(message).byte('I').int32(16384).byte('N').int16(4).text("1").text("2").text("3").text("4").Bytes(), err: true},
+		{name: "unsupported tuple kind", data: new(message).byte('I').int32(16384).byte('N').int16(1).byte('b').Bytes(), err: true},
+		{name: "truncated value", data: new(message).byte('I').int32(16384).byte('N').int16(1).byte('t').int32(10).append([]byte("1")).Bytes(), err: true},
+		{name: "truncated commit", data: new(message).byte('C').byte(0).int64(0x100).Bytes(), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parsePgOutput(test.data, relations)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", parsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parsed, test.expected) {
+				t.Errorf("got %#v, expected %#v", parsed, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseCopyData(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected any
+		err      bool
+	}{
+		{
+			name:     "xlog data",
+			data:     new(message).byte('w').int64(0x10).int64(0x20).int64(0).append([]byte("B")).Bytes(),
+			expected: xLogData{WALStart: 0x10, WALEnd: 0x20, Data: []byte("B")},
+		},
+		{
+			name:     "keepalive requesting a reply",
+			data:     new(message).byte('k').int64(0x20).int64(0).byte(1).Bytes(),
+			expected: primaryKeepalive{WALEnd: 0x20, ReplyRequested: true},
+		},
+		{name: "empty", data: nil, err: true},
+		{name: "unknown type", data: []byte("x"), err: true},
+		{name: "truncated keepalive", data: new(message).byte('k').int64(0x20).Bytes(), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := parseCopyData(test.data)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(data, test.expected) {
+				t.Errorf("got %#v, expected %#v", data, test.expected)
+			}
+		})
+	}
+}
+
+func TestEncodeStandbyStatus(t *testing.T) {
+	for _, replyRequested := range []bool{false, true} {
+		status := encodeStandbyStatus(0x1_0000_0200, replyRequested)
+		if len(status) != 34 || status[0] != 'r' {
+			t.Fatalf("invalid standby status %x", status)
+		}
+		for i := 0; i < 3; i++ {
+			if lsn := LSN(binary.BigEndian.Uint64(status[1+i*8:])); lsn != 0x1_0000_0200 {
+				t.Errorf("position %d is %s, expected 1/200", i, lsn)
+			}
+		}
+		if clock := int64(binary.BigEndian.Uint64(status[25:])); clock <= 0 {
+			t.Errorf("invalid clock %d", clock)
+		}
+		if (status[33] == 1) != replyRequested {
+			t.Errorf("reply requested is %d, expected %t", status[33], replyRequested)
+		}
+	}
+}
+
+func TestParseLSN(t *testing.T) {
+	tests := map[string]LSN{"0/0": 0, "1/200": 0x1_0000_0200, "16/B374D848": 0x16_B374_D848}
+	for text, expected := range tests {
+		lsn, err := parseLSN(text)
+		if err != nil || lsn != expected {
+			t.Errorf("parseLSN(%s) = %s, %v, expected %s", text, lsn, err, expected)
+		}
+		if lsn.String() != text {
+			t.Errorf("%s formatted as %s", text, lsn)
+		}
+	}
+	if _, err := parseLSN("invalid"); err == nil {
+		t.Error("expected an error for an invalid LSN")
+	}
+}
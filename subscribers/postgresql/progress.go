@@ -0,0 +1,104 @@
+package postgresql
+
+import (
+	"context"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"sync"
+)
+
+// replicationProgress confirm a commit once every event of its transaction and of previous ones is acknowledged
+type replicationProgress struct {
+	lock      sync.Mutex
+	pending   []*replicationTransaction // Committed or current transactions, in stream order
+	current   *replicationTransaction
+	confirmed LSN
+	rejected  bool
+}
+
+type replicationTransaction struct {
+	events    int // Dispatched events not acknowledged yet
+	committed bool
+	endLSN    LSN
+}
+
+func (pg *ReplicationSubscriber) newReplicationProgress() (*replicationProgress, error) {
+	var confirmed *string
+	err := pg.conn.QueryRow(context.Background(), `SELECT confirmed_flush_lsn::TEXT FROM pg_replication_slots WHERE slot_name = $1`, pg.Slot).Scan(&confirmed)
+	if err != nil {
+		return nil, err
+	}
+	progress := &replicationProgress{}
+	if confirmed != nil {
+		progress.confirmed, err = parseLSN(*confirmed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return progress, nil
+}
+
+func (progress *replicationProgress) begin() {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	progress.current = &replicationTransaction{}
+	progress.pending = append(progress.pending, progress.current)
+}
+
+func (progress *replicationProgress) commit(lsn LSN) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	if progress.current == nil {
+		return
+	}
+	progress.current.committed = true
+	progress.current.endLSN = lsn
+	progress.current = nil
+}
+
+func (progress *replicationProgress) idle(lsn LSN) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	if progress.current == nil && len(progress.pending) == 0 && lsn > progress.confirmed {
+		progress.confirmed = lsn
+	}
+}
+
+func (progress *replicationProgress) track() types.Acknowledgement {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	transaction := progress.current
+	if transaction == nil {
+		return types.Acknowledgement{}
+	}
+	transaction.events++
+
+	var once sync.Once
+	return types.Acknowledgement{
+		Ack: func() {
+			once.Do(func() {
+				progress.lock.Lock()
+				defer progress.lock.Unlock()
+				transaction.events--
+			})
+		},
+		Nack: func() {
+			once.Do(func() {
+				progress.lock.Lock()
+				defer progress.lock.Unlock()
+				progress.rejected = true
+			})
+		},
+	}
+}
+
+func (progress *replicationProgress) getConfirmed() (LSN, bool) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	for len(progress.pending) > 0 && progress.pending[0].committed && progress.pending[0].events == 0 {
+		if progress.pending[0].endLSN > progress.confirmed {
+			progress.confirmed = progress.pending[0].endLSN
+		}
+		progress.pending = progress.pending[1:]
+	}
+	return progress.confirmed, progress.rejected
+}
@@ -0,0 +1,116 @@
+package postgresql
+
+import (
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"testing"
+)
+
+func TestReplicationProgressGetConfirmed(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      func(progress *replicationProgress)
+		expected LSN
+		rejected bool
+	}{
+		{
+			name: "idle server position",
+			run: func(progress *replicationProgress) {
+				progress.idle(0x300)
+			},
+			expected: 0x300,
+		},
+		{
+			name: "transaction without event",
+			run: func(progress *replicationProgress) {
+				progress.begin()
+				progress.commit(0x200)
+			},
+			expected: 0x200,
+		},
+		{
+			name: "uncommitted transaction",
+			run: func(progress *replicationProgress) {
+				progress.begin()
+				progress.idle(0x300)
+			},
+			expected: 0x100,
+		},
+		{
+			name: "acknowledged events",
+			run: func(progress *replicationProgress) {
+				progress.begin()
+				first, second := progress.track(), progress.track()
+				progress.commit(0x200)
+				first.Ack()
+				second.Ack()
+				second.Ack()
+			},
+			expected: 0x200,
+		},
+		{
+			name: "event waiting for acknowledgement",
+			run: func(progress *replicationProgress) {
+				progress.begin()
+				progress.track().Ack()
+				progress.track()
+				progress.commit(0x200)
+			},
+			expected: 0x100,
+		},
+		{
+			name: "later transaction acknowledged first",
+			run: func(progress *replicationProgress) {
+				progress.begin()
+				progress.track()
+				progress.commit(0x200)
+				progress.begin()
+				progress.track().Ack()
+				progress.commit(0x300)
+			},
+			expected: 0x100,
+		},
+		{
+			name: "transactions acknowledged in order",
+			run: func(progress *replicationProgress) {
+				var acks []types.Acknowledgement
+				for _, lsn := range []LSN{0x200, 0x300, 0x400} {
+					progress.begin()
+					acks = append(acks, progress.track())
+					progress.commit(lsn)
+				}
+				acks[1].Ack()
+				acks[0].Ack()
+			},
+			expected: 0x300,
+		},
+		{
+			name: "rejected event",
+			run: func(progress *replicationProgress) {
+				progress.begin()
+				ack := progress.track()
+				progress.commit(0x200)
+				ack.Nack()
+				ack.Ack()
+			},
+			expected: 0x100,
+			rejected: true,
+		},
+		{
+			name: "idle behind confirmed position",
+			run: func(progress *replicationProgress) {
+				progress.idle(0x50)
+			},
+			expected: 0x100,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			progress := &replicationProgress{confirmed: 0x100}
+			test.run(progress)
+			confirmed, rejected := progress.getConfirmed()
+			if confirmed != test.expected || rejected != test.rejected {
+				t.Errorf("got %s, %t, expected %s, %t", confirmed, rejected, test.expected, test.rejected)
+			}
+		})
+	}
+}
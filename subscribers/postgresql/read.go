@@ -0,0 +1,235 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"github.com/quix-labs/pg-el-sync/internals/utils"
+	"strings"
+	"time"
+)
+
+// initReadConn connect the optional read replica, inheriting the connection keys of the primary
+func (pg *Subscriber) initReadConn(config map[string]any) {
+	var readConfig map[string]any
+	if utils.ParseMapKey(config, "read", &readConfig) != nil || readConfig == nil {
+		return
+	}
+
+	merged := map[string]any{}
+	for key := range connectionKeys {
+		if value, exists := config[key]; exists {
+			merged[key] = value
+		}
+	}
+	for _, key := range []string{"dsn", "params"} {
+		if value, exists := config[key]; exists {
+			merged[key] = value
+		}
+	}
+	for key, value := range readConfig {
+		merged[key] = value
+	}
+
+	var maxLag string
+	pg.MaxReadLag = DefaultMaxReadLag
+	if utils.ParseMapKey(readConfig, "max_lag", &maxLag) == nil {
+		duration, err := time.ParseDuration(maxLag)
+		if err != nil {
+			pg.Logger.Fatal().Err(err).Msgf("Invalid read max_lag %s", maxLag)
+		}
+		pg.MaxReadLag = duration
+	}
+
+	connString, err := getConnString(merged)
+	if err != nil {
+		pg.Logger.Fatal().Err(err).Msg("Invalid read connection configuration")
+	}
+	connConf, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		pg.Logger.Fatal().Err(err).Msg("Invalid read connection configuration")
+	}
+	pg.readConfig = connConf
+	if pg.readConn, err = pgxpool.NewWithConfig(context.Background(), connConf); err != nil {
+		pg.Logger.Fatal().Err(err).Msgf("Unable to connect to read database: %v", err)
+	}
+	pg.Logger.Printf("Documents are read from %s@%s/%s", connConf.ConnConfig.User, connConf.ConnConfig.Host, connConf.ConnConfig.Database)
+}
+
+// getReadConn return the replica once it replayed the primary position, the primary otherwise
+func (pg *Subscriber) getReadConn() *pgxpool.Pool {
+	if pg.readConn == nil {
+		return pg.conn
+	}
+	var position string
+	err := pg.conn.QueryRow(context.Background(), `SELECT pg_current_wal_lsn()::TEXT`).Scan(&position)
+	if err != nil {
+		pg.Logger.Printf("Cannot get primary WAL position, reading from primary: %s", err)
+		return pg.conn
+	}
+	lsn, err := parseLSN(position)
+	if err != nil {
+		pg.Logger.Printf("Cannot get primary WAL position, reading from primary: %s", err)
+		return pg.conn
+	}
+
+	pg.readLock.Lock()
+	defer pg.readLock.Unlock()
+	if pg.readReplayed >= lsn {
+		return pg.readConn
+	}
+	if time.Now().Before(pg.readLagging) {
+		return pg.conn
+	}
+
+	deadline := time.Now().Add(pg.MaxReadLag)
+	for {
+		err = pg.readConn.QueryRow(context.Background(), `SELECT COALESCE(pg_last_wal_replay_lsn(), '0/0')::TEXT`).Scan(&position)
+		if err == nil {
+			pg.readReplayed, err = parseLSN(position)
+		}
+		if err != nil {
+			pg.Logger.Printf("Cannot get replica WAL position, reading from primary: %s", err)
+			return pg.conn
+		}
+		if pg.readReplayed >= lsn {
+			return pg.readConn
+		}
+		if time.Now().After(deadline) {
+			pg.readLagging = time.Now().Add(ReadLagCooldown)
+			pg.Logger.Printf("Replica lags more than %s, reading from primary for %s", pg.MaxReadLag, ReadLagCooldown)
+			return pg.conn
+		}
+		time.Sleep(ReadLagPollInterval)
+	}
+}
+
+func (pg *Subscriber) readsReindexFromReplica(shared string, sharedReplica bool) bool {
+	if pg.readConn == nil {
+		return false
+	}
+	if shared != "" {
+		return sharedReplica
+	}
+	return pg.getReadConn() == pg.readConn
+}
+
+func (pg *Subscriber) getReplicaSnapshot(run *stagingRun, shared string) (string, error) {
+	if shared != "" {
+		return shared, nil
+	}
+	conn, err := pgx.ConnectConfig(context.Background(), pg.readConfig.ConnConfig.Copy())
+	if err != nil {
+		return "", err
+	}
+	tx, snapshot, err := exportSnapshot(conn)
+	if err != nil {
+		_ = conn.Close(context.Background())
+		return "", err
+	}
+	run.releases = append(run.releases, func() {
+		_ = tx.Rollback(context.Background())
+		_ = conn.Close(context.Background())
+	})
+	return snapshot, nil
+}
+
+// getReplicaQuery compute relations using views as materialized CTEs, nested ones first
+func (pg *Subscriber) getReplicaQuery(index *types.Index) string {
+	staged := stagedTables{}
+	var views []string
+	for _, level := range getStagingLevels(index.GetAllRelationsAsView()) {
+		for _, view := range level {
+			r := Relation(*view)
+			query := r.GetSelectQuery(staged)
+			staged[r.UniqueName] = fmt.Sprintf(`"%s%d"`, StagingViewPrefix, len(views))
+			views = append(views, fmt.Sprintf(`%s AS MATERIALIZED (%s)`, staged[r.UniqueName], query))
+		}
+	}
+	query := pg.getSelectQuery(index, staged) + " " + pg.GetWhereQuery(index)
+	if len(views) > 0 {
+		query = "WITH " + strings.Join(views, ", ") + " " + query
+	}
+	return "SELECT * FROM (" + query + `) AS "records"`
+}
+
+func (pg *Subscriber) getReferencesQuery(idx *types.Index) string {
+	index := Index(*idx)
+	return "SELECT * FROM (" + index.GetReferencesQuery() + `) AS "records"`
+}
+
+// getCursorRecords stream records by keyset pages of a cursor, in a replica session importing snapshot
+func (pg *Subscriber) getCursorRecords(snapshot string, query string, conditions []string, args queryArgs, keyset keyset, chunkSize int, checkpoint func(reference string)) <-chan types.Record {
+	ch := make(chan types.Record)
+	go func() {
+		defer close(ch)
+
+		conn, err := pgx.ConnectConfig(context.Background(), pg.readConfig.ConnConfig.Copy())
+		if err != nil {
+			ch <- types.Record{Err: err}
+			return
+		}
+		defer conn.Close(context.Background())
+		tx, err := conn.BeginTx(context.Background(), pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+		if err != nil {
+			ch <- types.Record{Err: err}
+			return
+		}
+		defer tx.Rollback(context.Background())
+		_, err = tx.Exec(context.Background(), fmt.Sprintf(`SET TRANSACTION SNAPSHOT '%s'`, snapshot))
+		if err == nil {
+			err = pg.setStatementTimeout(tx)
+		}
+		if err != nil {
+			ch <- types.Record{Err: err}
+			return
+		}
+
+		if len(conditions) > 0 {
+			query += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		_, err = tx.Exec(context.Background(), `DECLARE "records" NO SCROLL CURSOR FOR `+query+` ORDER BY `+keyset.getOrderSql(), args...)
+		if err != nil {
+			ch <- types.Record{Err: err}
+			return
+		}
+		for {
+			pg.waitForLoad()
+			records, count, err := pg.fetchCursor(tx, chunkSize)
+			if err != nil {
+				ch <- types.Record{Err: err}
+				return
+			}
+			for _, record := range records {
+				if checkpoint != nil {
+					reference := record.Reference
+					record.Checkpoint = func() { checkpoint(reference) }
+				}
+				ch <- record
+			}
+			if count < chunkSize {
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+func (pg *Subscriber) fetchCursor(tx pgx.Tx, chunkSize int) (records []types.Record, count int, err error) {
+	rows, err := tx.Query(context.Background(), fmt.Sprintf(`FETCH FORWARD %d FROM "records"`, chunkSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		count++
+		record, ok := pg.scanRecord(rows)
+		if ok {
+			records = append(records, record)
+		}
+	}
+	return records, count, rows.Err()
+}
@@ -8,19 +8,20 @@ import (
 
 type Relation types.Relation
 
-func (rel *Relation) GetSelectQuery() string {
+func (rel *Relation) GetSelectQuery(staged stagedTables) string {
 	additionalFields := map[string]string{}
 	var leftJoins []string
+	alias := rel.getAlias()
 
 	for _, relation := range rel.Relations {
 		subrel := Relation(*relation)
 		additionalFields[relation.Name] = subrel.GetLeftJoinField()
-		leftJoins = append(leftJoins, subrel.GetLeftJoinQuery(rel.Table))
+		leftJoins = append(leftJoins, subrel.GetLeftJoinQuery(alias, staged))
 	}
 
-	softDeleteWhere := ""
-	if rel.SoftDelete {
-		softDeleteWhere = fmt.Sprintf(`WHERE "%s"."%s" IS NULL`, rel.Table, "deleted_at")
+	filterWhere := ""
+	if rel.hasFilter() {
+		filterWhere = "WHERE " + rel.getFilterSql(alias, false)
 	}
 
 	fields := Fields(rel.Fields)
@@ -28,72 +29,107 @@ func (rel *Relation) GetSelectQuery() string {
 	switch rel.Type {
 	case "one_to_many":
 		return fmt.Sprintf(
-			`SELECT JSON_AGG(%s) AS "result", "%s"."%s" AS parent_ref FROM "%s" %s %s GROUP BY "%s"."%s"`,
-			fields.asJsonBuildObjectQuery(rel.Table, additionalFields),
-			rel.Table,
+			`SELECT JSON_AGG(%s) AS "result", "%s"."%s" AS parent_ref FROM %s AS "%s" %s %s GROUP BY "%s"."%s"`,
+			fields.asJsonBuildObjectQuery(alias, additionalFields),
+			alias,
 			rel.ForeignKey.Local,
-			rel.Table,
+			quoteTable(rel.Schema, rel.Table),
+			alias,
 			strings.Join(leftJoins, " "),
-			softDeleteWhere,
-			rel.Table,
+			filterWhere,
+			alias,
 			rel.ForeignKey.Local,
 		)
 	case "one_to_one":
 		return fmt.Sprintf(
-			`SELECT %s AS "result", "%s"."%s" AS parent_ref FROM "%s" %s %s`,
-			fields.asJsonBuildObjectQuery(rel.Table, additionalFields),
-			rel.Table,
+			`SELECT %s AS "result", "%s"."%s" AS parent_ref FROM %s AS "%s" %s %s`,
+			fields.asJsonBuildObjectQuery(alias, additionalFields),
+			alias,
 			rel.ForeignKey.Local,
-			rel.Table,
+			quoteTable(rel.Schema, rel.Table),
+			alias,
 			strings.Join(leftJoins, " "),
-			softDeleteWhere,
+			filterWhere,
 		)
 	case "many_to_many":
+		pivotAlias := rel.getPivotAlias()
 		if rel.ForeignKey.PivotFields.Len() > 0 {
 			pivotFields := Fields(rel.ForeignKey.PivotFields)
-			for alias, raw := range pivotFields.getParsedFields(rel.ForeignKey.PivotTable, nil) {
-				additionalFields[alias] = raw
+			for field, raw := range pivotFields.getParsedFields(pivotAlias, nil) {
+				additionalFields[field] = raw
 			}
 		}
 		return fmt.Sprintf(
-			`SELECT JSON_AGG(%s) AS "result", "%s"."%s" AS parent_ref %s FROM "%s" INNER JOIN "%s" ON "%s"."%s"="%s"."%s" %s GROUP BY "%s"."%s"`,
-			fields.asJsonBuildObjectQuery(rel.Table, additionalFields),
-			rel.ForeignKey.PivotTable,
+			`SELECT JSON_AGG(%s) AS "result", "%s"."%s" AS parent_ref FROM %s AS "%s" INNER JOIN %s AS "%s" ON "%s"."%s"="%s"."%s" %s %s GROUP BY "%s"."%s"`,
+			fields.asJsonBuildObjectQuery(alias, additionalFields),
+			pivotAlias,
 			rel.ForeignKey.PivotLocal,
-			softDeleteWhere,
-			rel.ForeignKey.PivotTable,
-			rel.Table,
-			rel.Table,
+			quoteTable(rel.ForeignKey.PivotSchema, rel.ForeignKey.PivotTable),
+			pivotAlias,
+			quoteTable(rel.Schema, rel.Table),
+			alias,
+			alias,
 			rel.ForeignKey.Parent,
-			rel.ForeignKey.PivotTable,
+			pivotAlias,
 			rel.ForeignKey.PivotRelated,
 			strings.Join(leftJoins, " "),
-			rel.ForeignKey.PivotTable,
+			filterWhere,
+			pivotAlias,
 			rel.ForeignKey.PivotLocal,
 		)
 	}
 	return ""
 }
-func (rel *Relation) GetLeftJoinQuery(parentTable string) string {
-	selectQuery := rel.GetSelectQuery()
-	if rel.ViewCreated {
-		selectQuery = fmt.Sprintf(`SELECT * FROM "%s"."%s"`, SchemaName, rel.ViewName)
+
+func (rel *Relation) getAlias() string {
+	return "rel_" + rel.UniqueName
+}
+
+func (rel *Relation) getPivotAlias() string {
+	return "pivot_" + rel.UniqueName
+}
+
+func (rel *Relation) getJoinAlias() string {
+	return "join_" + rel.UniqueName
+}
+
+func (rel *Relation) getFilterWheres() Wheres {
+	wheres := Wheres(rel.Wheres)
+	if rel.SoftDelete != nil {
+		wheres = append(Wheres{rel.SoftDelete}, wheres...)
+	}
+	return wheres
+}
+
+func (rel *Relation) hasFilter() bool {
+	return len(rel.getFilterWheres()) > 0
+}
+
+func (rel *Relation) getFilterSql(table string, stripQuote bool) string {
+	wheres := rel.getFilterWheres()
+	return wheres.GetConditionSql(table, stripQuote)
+}
+
+func (rel *Relation) GetLeftJoinQuery(parentAlias string, staged stagedTables) string {
+	selectQuery := rel.GetSelectQuery(staged)
+	if table, ok := staged[rel.UniqueName]; ok {
+		selectQuery = `SELECT * FROM ` + table
 	}
 	return fmt.Sprintf(
 		`LEFT OUTER JOIN (%s) AS "%s" ON "%s"."parent_ref" = "%s"."%s"`,
 		selectQuery,
-		rel.Name,
-		rel.Name,
-		parentTable,
+		rel.getJoinAlias(),
+		rel.getJoinAlias(),
+		parentAlias,
 		rel.ForeignKey.Parent,
 	)
 }
 
 func (rel *Relation) GetLeftJoinField() string {
-	return fmt.Sprintf(`"%s"."result"`, rel.Name)
+	return fmt.Sprintf(`"%s"."result"`, rel.getJoinAlias())
 }
 
-func (rel *Relation) GetReverseSelectQuery(table string, events []*types.RelationUpdateEvent, subExists string) string {
+func (rel *Relation) GetReverseSelectQuery(indexAlias string, events []*types.RelationUpdateEvent, subExists string, args *queryArgs) string {
 
 	andRaw := ""
 	if events != nil && len(events) > 0 {
@@ -101,67 +137,77 @@ func (rel *Relation) GetReverseSelectQuery(table string, events []*types.Relatio
 		var relatedReferences []string
 		for _, event := range events {
 			if event.Pivot {
-				pivotRelatedReferences = append(pivotRelatedReferences, `'`+event.Reference+`'`)
+				pivotRelatedReferences = append(pivotRelatedReferences, event.Reference)
 			} else {
-				relatedReferences = append(relatedReferences, `'`+event.Reference+`'`)
+				relatedReferences = append(relatedReferences, event.Reference)
 			}
 		}
 		var wheres []string
 		if len(relatedReferences) > 0 {
-			wheres = append(wheres, fmt.Sprintf(`"%s"."%s"::TEXT IN (%s)`,
-				rel.Table,
+			wheres = append(wheres, fmt.Sprintf(`"%s"."%s" = ANY(%s)`,
+				rel.getAlias(),
 				rel.ForeignKey.Local,
-				strings.Join(relatedReferences, ","),
+				args.add(textArray(relatedReferences)),
 			))
 		}
 		if len(pivotRelatedReferences) > 0 {
-			wheres = append(wheres, fmt.Sprintf(`"%s"."%s"::TEXT IN (%s)`,
-				rel.ForeignKey.PivotTable,
+			wheres = append(wheres, fmt.Sprintf(`"%s"."%s" = ANY(%s)`,
+				rel.getPivotAlias(),
 				rel.ForeignKey.PivotLocal,
-				strings.Join(pivotRelatedReferences, ","),
+				args.add(textArray(pivotRelatedReferences)),
 			))
 		}
 		andRaw = `AND (` + strings.Join(wheres, " OR ") + ")"
 	}
-	fromTable := table
+	parentAlias := indexAlias
 	if rel.Parent != nil {
-		fromTable = rel.Parent.Table
+		parent := Relation(*rel.Parent)
+		parentAlias = parent.getAlias()
 	}
+	alias, pivotAlias := rel.getAlias(), rel.getPivotAlias()
 	var selectSql string
 	switch rel.Type {
 	case "one_to_many", "one_to_one":
 		selectSql = fmt.Sprintf(
-			`SELECT * FROM "%s" WHERE "%s"."%s" = "%s"."%s" %s`,
-			rel.Table,
-			fromTable,
+			`SELECT * FROM %s AS "%s" WHERE "%s"."%s" = "%s"."%s" %s`,
+			quoteTable(rel.Schema, rel.Table),
+			alias,
+			parentAlias,
 			rel.ForeignKey.Parent,
-			rel.Table,
+			alias,
 			rel.ForeignKey.Local,
 			andRaw,
 		)
 	case "many_to_many":
 		selectSql = fmt.Sprintf(
-			`SELECT * FROM "%s" INNER JOIN "%s" ON "%s"."%s"="%s"."%s" WHERE "%s"."%s" = "%s"."%s" %s`,
-			rel.Table,
-			rel.ForeignKey.PivotTable,
-			rel.Table,
+			`SELECT * FROM %s AS "%s" INNER JOIN %s AS "%s" ON "%s"."%s"="%s"."%s" WHERE "%s"."%s" = "%s"."%s" %s`,
+			quoteTable(rel.Schema, rel.Table),
+			alias,
+			quoteTable(rel.ForeignKey.PivotSchema, rel.ForeignKey.PivotTable),
+			pivotAlias,
+			alias,
 			rel.ForeignKey.Local,
-			rel.ForeignKey.PivotTable,
+			pivotAlias,
 			rel.ForeignKey.PivotRelated,
-			fromTable,
+			parentAlias,
 			rel.ForeignKey.Parent,
-			rel.ForeignKey.PivotTable,
+			pivotAlias,
 			rel.ForeignKey.PivotLocal,
 			andRaw,
 		)
 	}
 	if subExists != "" {
-		selectSql += `AND EXISTS (` + subExists + `)`
+		// Filtered intermediate rows do not link the changed row to the document,
+		// the changed row itself is not filtered as it may have just left the filter
+		if rel.hasFilter() {
+			selectSql += ` AND (` + rel.getFilterSql(alias, false) + `)`
+		}
+		selectSql += ` AND EXISTS (` + subExists + `)`
 	}
 
 	if rel.Parent != nil {
 		parent := Relation(*rel.Parent)
-		selectSql = parent.GetReverseSelectQuery(table, nil, selectSql)
+		selectSql = parent.GetReverseSelectQuery(indexAlias, nil, selectSql, args)
 	}
 
 	return selectSql
@@ -0,0 +1,497 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"github.com/quix-labs/pg-el-sync/internals/utils"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPublicationName = "pgsync_publication"
+	DefaultSlotName        = "pgsync_slot"
+	StandbyStatusInterval  = time.Second * 10
+	PublicationComment     = "Created by pg-el-sync"
+	ReplicationBatchSize   = 1000 // Changes whose wheres are evaluated by a single query, flushed on commit
+)
+
+// ReplicationSubscriber consume a publication through a logical replication slot instead of triggers
+type ReplicationSubscriber struct {
+	Subscriber
+	Publication string
+	Slot        string
+
+	listeners map[string][]*replicationListener
+}
+
+type replicationListener struct {
+	index    *types.Index
+	relation *types.Relation
+	pivot    bool
+}
+
+func (pg *ReplicationSubscriber) Init(config map[string]any) {
+	pg.Subscriber.Init(config)
+	err := utils.ParseMapKey(config, "publication", &pg.Publication)
+	if err != nil || pg.Publication == "" {
+		pg.Publication = DefaultPublicationName
+	}
+	err = utils.ParseMapKey(config, "slot", &pg.Slot)
+	if err != nil || pg.Slot == "" {
+		pg.Slot = DefaultSlotName
+	}
+}
+
+// -----------------------------------------------PREPARATION------------------------------------------------
+
+func (pg *ReplicationSubscriber) PrepareListen(indices []*types.Index) {
+	pg.indices = indices
+	pg.loadListeners(indices)
+	pg.initPublication()
+	pg.initSlot()
+}
+
+func (pg *ReplicationSubscriber) GetInstallStatements(indices []*types.Index) []string {
+	pg.loadListeners(indices)
+	var tables []string
+	for table := range pg.listeners {
+		parts := strings.SplitN(table, ".", 2)
+		tables = append(tables, fmt.Sprintf(`"%s"."%s"`, parts[0], parts[1]))
+	}
+	sort.Strings(tables)
+	return []string{
+		fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s"`, pg.Schema),
+		pg.getCheckpointTableSql(),
+		fmt.Sprintf(`CREATE PUBLICATION "%s" FOR TABLE %s`, pg.Publication, strings.Join(tables, ", ")),
+		pg.getPublicationCommentSql(),
+	}
+}
+
+func (pg *ReplicationSubscriber) GetNonTransactionalStatements(indices []*types.Index) []string {
+	return []string{fmt.Sprintf(`SELECT pg_create_logical_replication_slot(%s, 'pgoutput')`, quoteLiteral(pg.Slot))}
+}
+
+func (pg *ReplicationSubscriber) loadListeners(indices []*types.Index) {
+	pg.listeners = make(map[string][]*replicationListener)
+	for _, index := range indices {
+		pg.addListener(index.Schema, index.Table, &replicationListener{index: index})
+		for _, relation := range index.GetAllRelations() {
+			pg.addListener(relation.Schema, relation.Table, &replicationListener{index: index, relation: relation})
+			if relation.Type == "many_to_many" {
+				pg.addListener(relation.ForeignKey.PivotSchema, relation.ForeignKey.PivotTable, &replicationListener{index: index, relation: relation, pivot: true})
+			}
+		}
+	}
+}
+
+func (pg *ReplicationSubscriber) addListener(schema string, table string, listener *replicationListener) {
+	if schema == "" {
+		schema = "public"
+	}
+	key := schema + "." + table
+	pg.listeners[key] = append(pg.listeners[key], listener)
+}
+
+func (pg *ReplicationSubscriber) initPublication() {
+	var exists bool
+	err := pg.conn.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM pg_publication WHERE pubname = $1)`, pg.Publication).Scan(&exists)
+	if err != nil {
+		pg.Logger.Fatal().Err(err).Msg("Error checking publication")
+	}
+
+	published := map[string]bool{}
+	if exists {
+		rows, err := pg.conn.Query(context.Background(), `SELECT schemaname || '.' || tablename FROM pg_publication_tables WHERE pubname = $1`, pg.Publication)
+		if err != nil {
+			pg.Logger.Fatal().Err(err).Msg("Error listing publication tables")
+		}
+		for rows.Next() {
+			var table string
+			if err = rows.Scan(&table); err == nil {
+				published[table] = true
+			}
+		}
+		rows.Close()
+	}
+
+	var missingTables []string
+	for table := range pg.listeners {
+		if !published[table] {
+			parts := strings.SplitN(table, ".", 2)
+			missingTables = append(missingTables, fmt.Sprintf(`"%s"."%s"`, parts[0], parts[1]))
+		}
+	}
+	if len(missingTables) == 0 {
+		return
+	}
+	if !pg.ManageTriggers {
+		pg.Logger.Fatal().Msgf("Publication %s does not publish %s, apply the export-sql migration", pg.Publication, strings.Join(missingTables, ", "))
+	}
+
+	sql := fmt.Sprintf(`CREATE PUBLICATION "%s" FOR TABLE %s`, pg.Publication, strings.Join(missingTables, ", "))
+	if exists {
+		sql = fmt.Sprintf(`ALTER PUBLICATION "%s" ADD TABLE %s`, pg.Publication, strings.Join(missingTables, ", "))
+	}
+	_, err = pg.conn.Exec(context.Background(), sql)
+	if err != nil {
+		pg.Logger.Fatal().Err(err).Msgf("Error preparing publication %s", pg.Publication)
+	}
+	if !exists {
+		_, err = pg.conn.Exec(context.Background(), pg.getPublicationCommentSql())
+		if err != nil {
+			pg.Logger.Fatal().Err(err).Msgf("Error marking publication %s", pg.Publication)
+		}
+	}
+}
+
+func (pg *ReplicationSubscriber) getPublicationCommentSql() string {
+	return fmt.Sprintf(`COMMENT ON PUBLICATION "%s" IS '%s'`, pg.Publication, PublicationComment)
+}
+
+func (pg *ReplicationSubscriber) initSlot() {
+	var exists bool
+	err := pg.conn.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, pg.Slot).Scan(&exists)
+	if err != nil {
+		pg.Logger.Fatal().Err(err).Msg("Error checking replication slot")
+	}
+	if exists {
+		return
+	}
+	if !pg.ManageTriggers {
+		pg.Logger.Fatal().Msgf("Replication slot %s does not exist, apply the export-sql migration", pg.Slot)
+	}
+	_, err = pg.conn.Exec(context.Background(), `SELECT pg_create_logical_replication_slot($1, 'pgoutput')`, pg.Slot)
+	if err != nil {
+		pg.Logger.Fatal().Err(err).Msgf("Error create replication slot %s", pg.Slot)
+	}
+	pg.Logger.Printf("Replication slot %s created", pg.Slot)
+}
+
+// -----------------------------------------------LISTEN------------------------------------------------
+
+func (pg *ReplicationSubscriber) Listen() {
+	delay := ReconnectMinDelay
+	for {
+		started, err := pg.stream()
+		if started {
+			delay = ReconnectMinDelay
+		}
+		pg.Logger.Printf("Replication stream interrupted: %s, reconnecting in %s", err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, ReconnectMaxDelay)
+	}
+}
+
+func (pg *ReplicationSubscriber) stream() (started bool, err error) {
+	progress, err := pg.newReplicationProgress()
+	if err != nil {
+		return false, err
+	}
+
+	connConfig := pg.connConfig.ConnConfig.Config.Copy()
+	connConfig.RuntimeParams["replication"] = "database"
+	conn, err := pgconn.ConnectConfig(context.Background(), connConfig)
+	if err != nil {
+		return false, fmt.Errorf("cannot get replication connection: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	err = pg.startReplication(conn)
+	if err != nil {
+		return false, fmt.Errorf("error starting replication: %w", err)
+	}
+	pg.markListening()
+
+	relations := map[uint32]*pgOutputRelation{}
+	var changes []relationChange
+	nextStatus := time.Now().Add(StandbyStatusInterval)
+	for {
+		if !time.Now().Before(nextStatus) {
+			confirmed, rejected := progress.getConfirmed()
+			if rejected {
+				return true, errors.New("publishing failed, receiving unconfirmed changes again")
+			}
+			err = pg.sendStandbyStatus(conn, confirmed)
+			if err != nil {
+				return true, fmt.Errorf("error sending standby status: %w", err)
+			}
+			nextStatus = time.Now().Add(StandbyStatusInterval)
+		}
+
+		ctx, cancel := context.WithDeadline(context.Background(), nextStatus)
+		msg, err := conn.ReceiveMessage(ctx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return true, fmt.Errorf("error waiting for replication message: %w", err)
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return true, pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyData:
+			// Undecodable changes are received again from the last confirmed position
+			data, err := parseCopyData(msg.Data)
+			if err != nil {
+				return true, err
+			}
+			switch data := data.(type) {
+			case primaryKeepalive:
+				progress.idle(data.WALEnd)
+				if data.ReplyRequested {
+					nextStatus = time.Now()
+				}
+			case xLogData:
+				message, err := parsePgOutput(data.Data, relations)
+				if err != nil {
+					return true, err
+				}
+				switch message := message.(type) {
+				case *pgOutputRelation:
+					relations[message.ID] = message
+				case pgOutputBegin:
+					progress.begin()
+				case pgOutputCommit:
+					err = pg.handleChanges(changes, progress)
+					if err != nil {
+						return true, err
+					}
+					changes = nil
+					progress.commit(message.EndLSN)
+				case pgOutputChange:
+					changes = append(changes, relationChange{change: message, rel: relations[message.Relation]})
+					if len(changes) >= ReplicationBatchSize {
+						err = pg.handleChanges(changes, progress)
+						if err != nil {
+							return true, err
+						}
+						changes = nil
+					}
+				}
+			}
+		}
+	}
+}
+
+func (pg *ReplicationSubscriber) startReplication(conn *pgconn.PgConn) error {
+	sql := fmt.Sprintf(
+		`START_REPLICATION SLOT "%s" LOGICAL 0/0 (proto_version '1', publication_names '"%s"')`,
+		pg.Slot,
+		pg.Publication,
+	)
+	conn.Frontend().Send(&pgproto3.Query{String: sql})
+	err := conn.Frontend().Flush()
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := conn.ReceiveMessage(context.Background())
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			pg.Logger.Printf("Replication started on slot %s", pg.Slot)
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+}
+
+func (pg *ReplicationSubscriber) sendStandbyStatus(conn *pgconn.PgConn, lsn LSN) error {
+	conn.Frontend().Send(&pgproto3.CopyData{Data: encodeStandbyStatus(lsn, false)})
+	return conn.Frontend().Flush()
+}
+
+// -----------------------------------------------EVENTS------------------------------------------------
+
+type relationChange struct {
+	change pgOutputChange
+	rel    *pgOutputRelation
+}
+
+type softDeletedKey struct {
+	index  *types.Index
+	change int
+	old    bool
+}
+
+func (pg *ReplicationSubscriber) handleChanges(changes []relationChange, progress *replicationProgress) error {
+	for _, c := range changes {
+		if c.change.OldFull && c.change.New != nil {
+			// Unchanged TOAST values are only sent in the old tuple
+			for column, value := range c.change.Old {
+				if _, exists := c.change.New[column]; !exists {
+					c.change.New[column] = value
+				}
+			}
+		}
+	}
+	softDeleted, err := pg.getSoftDeleted(changes)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range changes {
+		for _, listener := range pg.listeners[c.rel.Namespace+"."+c.rel.Name] {
+			var payloads []*notificationPayload
+			switch {
+			case listener.relation == nil:
+				payloads = pg.getTablePayloads(listener.index, c.change, softDeleted[softDeletedKey{listener.index, i, false}], softDeleted[softDeletedKey{listener.index, i, true}])
+			case listener.pivot:
+				payloads = pg.getPivotPayloads(listener.index, listener.relation, c.change)
+			default:
+				payloads = pg.getRelationPayloads(listener.index, listener.relation, c.change, c.rel)
+			}
+			for _, payload := range payloads {
+				event, err := pg.parsePayload(payload, progress.track())
+				if err != nil {
+					pg.Logger.Print(err)
+					continue
+				}
+				pg.DispatchEvent(event)
+			}
+		}
+	}
+	return nil
+}
+
+func (pg *ReplicationSubscriber) getTablePayloads(index *types.Index, change pgOutputChange, softDeleted bool, oldSoftDeleted bool) []*notificationPayload {
+	payload := &notificationPayload{Type: "table", Index: index.Name, Action: change.Action}
+	switch change.Action {
+	case "insert":
+		payload.Reference = tupleReference(change.New, index.ReferenceFields)
+	case "update":
+		payload.Reference = tupleReference(change.New, index.ReferenceFields)
+		payload.OldReference = payload.Reference
+		if change.Old != nil {
+			payload.OldReference = tupleReference(change.Old, index.ReferenceFields)
+		}
+		payload.SoftDeleted = softDeleted
+		payload.OldSoftDeleted = oldSoftDeleted
+	case "delete":
+		payload.Reference = tupleReference(change.Old, index.ReferenceFields)
+	}
+	return []*notificationPayload{payload}
+}
+
+func (pg *ReplicationSubscriber) getRelationPayloads(index *types.Index, relation *types.Relation, change pgOutputChange, rel *pgOutputRelation) []*notificationPayload {
+	var references []string
+	if reference := tupleValue(change.New, relation.ForeignKey.Local); reference != "" {
+		references = append(references, reference)
+	}
+	if reference := tupleValue(change.Old, relation.ForeignKey.Local); reference != "" {
+		references = append(references, reference)
+	}
+	if change.Action == "delete" && len(references) == 0 {
+		pg.Logger.Printf("Column %s missing from deleted row in %s, set REPLICA IDENTITY FULL on this table", relation.ForeignKey.Local, rel.Name)
+	}
+
+	var payloads []*notificationPayload
+	for _, reference := range utils.Unique(references) {
+		payloads = append(payloads, &notificationPayload{
+			Type:      "relation",
+			Index:     index.Name,
+			Relation:  relation.UniqueName,
+			Reference: reference,
+		})
+	}
+	return payloads
+}
+
+func (pg *ReplicationSubscriber) getPivotPayloads(index *types.Index, relation *types.Relation, change pgOutputChange) []*notificationPayload {
+	return []*notificationPayload{{
+		Type:       "relation_pivot",
+		Index:      index.Name,
+		Relation:   relation.UniqueName,
+		Local:      tupleValue(change.New, relation.ForeignKey.PivotLocal),
+		OldLocal:   tupleValue(change.Old, relation.ForeignKey.PivotLocal),
+		Related:    tupleValue(change.New, relation.ForeignKey.PivotRelated),
+		OldRelated: tupleValue(change.Old, relation.ForeignKey.PivotRelated),
+	}}
+}
+
+func (pg *ReplicationSubscriber) getSoftDeleted(changes []relationChange) (map[softDeletedKey]bool, error) {
+	keys := map[*types.Index][]softDeletedKey{}
+	tuples := map[*types.Index][]pgOutputTuple{}
+	for i, c := range changes {
+		if c.change.Action != "update" {
+			continue
+		}
+		for _, listener := range pg.listeners[c.rel.Namespace+"."+c.rel.Name] {
+			if listener.relation != nil || len(listener.index.Wheres) == 0 {
+				continue
+			}
+			keys[listener.index] = append(keys[listener.index], softDeletedKey{listener.index, i, false})
+			tuples[listener.index] = append(tuples[listener.index], c.change.New)
+			if c.change.OldFull {
+				keys[listener.index] = append(keys[listener.index], softDeletedKey{listener.index, i, true})
+				tuples[listener.index] = append(tuples[listener.index], c.change.Old)
+			}
+		}
+	}
+
+	softDeleted := map[softDeletedKey]bool{}
+	for index, indexKeys := range keys {
+		values, err := pg.isSoftDeleted(index, tuples[index])
+		if err != nil {
+			return nil, fmt.Errorf("cannot evaluate wheres for %s: %w", index.Name, err)
+		}
+		for i, key := range indexKeys {
+			softDeleted[key] = values[i]
+		}
+	}
+	return softDeleted, nil
+}
+
+func (pg *ReplicationSubscriber) isSoftDeleted(index *types.Index, tuples []pgOutputTuple) ([]bool, error) {
+	rows, err := json.Marshal(tuples)
+	if err != nil {
+		return nil, err
+	}
+	wheres := Wheres(index.Wheres)
+	result, err := pg.conn.Query(context.Background(), fmt.Sprintf(
+		`SELECT COALESCE(NOT (%s), false) FROM json_populate_recordset(NULL::%s, $1::json) WITH ORDINALITY AS "%s" ORDER BY "%s"."ordinality"`,
+		wheres.GetConditionSql(IndexAlias, false),
+		quoteTable(index.Schema, index.Table),
+		IndexAlias,
+		IndexAlias,
+	), string(rows))
+	if err != nil {
+		return nil, err
+	}
+	values, err := pgx.CollectRows(result, pgx.RowTo[bool])
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(tuples) {
+		return nil, fmt.Errorf("%d rows evaluated instead of %d", len(values), len(tuples))
+	}
+	return values, nil
+}
+
+func tupleValue(tuple pgOutputTuple, column string) string {
+	if value, exists := tuple[column]; exists && value != nil {
+		return *value
+	}
+	return ""
+}
+
+func tupleReference(tuple pgOutputTuple, fields []string) string {
+	var values []*string
+	for _, field := range fields {
+		values = append(values, tuple[field])
+	}
+	return types.EncodeReference(values)
+}
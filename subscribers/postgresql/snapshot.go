@@ -0,0 +1,120 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"sync"
+)
+
+func (pg *Subscriber) markListening() {
+	pg.listeningOnce.Do(func() { close(pg.listening) })
+}
+
+// ExportSnapshot export the snapshot reindex views are built from once the subscriber listens
+func (pg *Subscriber) ExportSnapshot() (func(), error) {
+	<-pg.listening
+
+	replica := pg.readConn != nil && pg.getReadConn() == pg.readConn
+	pool := pg.conn
+	if replica {
+		pool = pg.readConn
+	}
+	conn, err := pool.Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	tx, snapshot, err := exportSnapshot(conn)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+	if replica {
+		pg.Logger.Printf("Snapshot %s exported on the replica", snapshot)
+	} else {
+		pg.Logger.Printf("Snapshot %s exported", snapshot)
+	}
+
+	release := sync.OnceFunc(func() {
+		pg.snapshotLock.Lock()
+		pg.snapshot, pg.snapshotReplica, pg.snapshotPending, pg.snapshotRelease = "", false, nil, nil
+		pg.snapshotLock.Unlock()
+		_ = tx.Rollback(context.Background())
+		conn.Release()
+	})
+	pg.snapshotLock.Lock()
+	defer pg.snapshotLock.Unlock()
+	pg.snapshot, pg.snapshotReplica, pg.snapshotRelease = snapshot, replica, release
+	pg.snapshotPending = map[string]bool{}
+	for _, index := range pg.indices {
+		pg.snapshotPending[index.Name] = true
+	}
+	return release, nil
+}
+
+func (pg *Subscriber) getSharedSnapshot() (string, bool) {
+	pg.snapshotLock.Lock()
+	defer pg.snapshotLock.Unlock()
+	return pg.snapshot, pg.snapshotReplica
+}
+
+// releaseStagedSnapshot release a primary snapshot once every listened index is staged
+func (pg *Subscriber) releaseStagedSnapshot(snapshot string, index string) {
+	pg.snapshotLock.Lock()
+	if pg.snapshot != snapshot || pg.snapshotReplica {
+		pg.snapshotLock.Unlock()
+		return
+	}
+	delete(pg.snapshotPending, index)
+	release, staged := pg.snapshotRelease, len(pg.snapshotPending) == 0
+	pg.snapshotLock.Unlock()
+	if staged {
+		pg.Logger.Printf("Snapshot %s released, every index is staged", snapshot)
+		release()
+	}
+}
+
+type txBeginner interface {
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+func exportSnapshot(conn txBeginner) (pgx.Tx, string, error) {
+	tx, err := conn.BeginTx(context.Background(), pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, "", err
+	}
+	var snapshot string
+	err = tx.QueryRow(context.Background(), `SELECT pg_export_snapshot()`).Scan(&snapshot)
+	if err != nil {
+		_ = tx.Rollback(context.Background())
+		return nil, "", err
+	}
+	return tx, snapshot, nil
+}
+
+func (pg *Subscriber) execStatements(snapshot string, statements []string) error {
+	tx, err := pg.conn.BeginTx(context.Background(), pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if snapshot != "" {
+		_, err = tx.Exec(context.Background(), fmt.Sprintf(`SET TRANSACTION SNAPSHOT '%s'`, snapshot))
+		if err != nil {
+			return err
+		}
+	}
+	// After the snapshot import, which must be the first statement
+	err = pg.setStatementTimeout(tx)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(context.Background(), statement)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
@@ -0,0 +1,251 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"github.com/quix-labs/pg-el-sync/internals/utils"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StagingTablePrefix = "stage_"
+	StagingViewPrefix  = "stage_view_" // Common table expressions of views read from the replica
+	LegacySchemaName   = "pgsync"      // Schema of previous versions, holding their materialized views
+)
+
+type stagedTables map[string]string
+
+// stagingRun own the staging tables of a full reindex, locked by its session until cleanup
+type stagingRun struct {
+	pg       *Subscriber
+	id       int32
+	conn     *pgx.Conn
+	connLock sync.Mutex
+	tables   []string
+	releases []func() // Called on cleanup
+}
+
+type stagingTable struct {
+	Name  string
+	Table string
+	Query string
+}
+
+func (pg *Subscriber) newStagingRun() (*stagingRun, error) {
+	pg.dropStaleStaging()
+
+	conn, err := pgx.ConnectConfig(context.Background(), pg.connConfig.ConnConfig.Copy())
+	if err != nil {
+		return nil, err
+	}
+	for {
+		id := rand.Int31()
+		var acquired bool
+		err = conn.QueryRow(context.Background(), `SELECT pg_try_advisory_lock(hashtext($1), $2)`, pg.Schema, id).Scan(&acquired)
+		if err != nil {
+			_ = conn.Close(context.Background())
+			return nil, err
+		}
+		if acquired {
+			return &stagingRun{pg: pg, id: id, conn: conn}, nil
+		}
+	}
+}
+
+func (run *stagingRun) newTable() string {
+	table := fmt.Sprintf(`"%s"."%s%d_%d"`, run.pg.Schema, StagingTablePrefix, run.id, len(run.tables))
+	run.tables = append(run.tables, table)
+	return table
+}
+
+func (run *stagingRun) getSnapshot(shared string) (snapshot string, release func(), err error) {
+	if shared != "" {
+		return shared, func() {}, nil
+	}
+	tx, snapshot, err := exportSnapshot(run.conn)
+	if err != nil {
+		return "", nil, err
+	}
+	return snapshot, func() { _ = tx.Rollback(context.Background()) }, nil
+}
+
+func (run *stagingRun) build(snapshot string, tables []stagingTable, concurrency int) error {
+	var wg sync.WaitGroup
+	builds := utils.NewSemaphore(concurrency)
+	errs := make([]error, len(tables))
+	for i, table := range tables {
+		builds.Acquire(1)
+		wg.Add(1)
+		go func(i int, table stagingTable) {
+			defer wg.Done()
+			defer builds.Release(1)
+			run.pg.waitForLoad()
+			start := time.Now()
+			err := run.pg.execStatements(snapshot, []string{fmt.Sprintf(`CREATE UNLOGGED TABLE %s AS(%s)`, table.Table, table.Query)})
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", table.Name, err)
+				return
+			}
+			run.pg.Logger.Printf("Staging %s built in %s", table.Name, time.Since(start).String())
+		}(i, table)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// getStagingLevels group views by level, leaves first, each view only reading views of previous levels
+func getStagingLevels(views types.Relations) [][]*types.Relation {
+	dependencies := map[*types.Relation][]*types.Relation{}
+	for _, view := range views {
+		for parent := view.Parent; parent != nil; parent = parent.Parent {
+			if parent.UsingView {
+				dependencies[parent] = append(dependencies[parent], view)
+				break
+			}
+		}
+	}
+
+	levels := map[*types.Relation]int{}
+	var getLevel func(view *types.Relation) int
+	getLevel = func(view *types.Relation) int {
+		if level, ok := levels[view]; ok {
+			return level
+		}
+		level := 0
+		for _, dependency := range dependencies[view] {
+			level = max(level, getLevel(dependency)+1)
+		}
+		levels[view] = level
+		return level
+	}
+
+	var grouped [][]*types.Relation
+	for _, view := range views {
+		level := getLevel(view)
+		for len(grouped) <= level {
+			grouped = append(grouped, nil)
+		}
+		grouped[level] = append(grouped[level], view)
+	}
+	for _, level := range grouped {
+		sort.Slice(level, func(i, j int) bool { return level[i].UniqueName < level[j].UniqueName })
+	}
+	return grouped
+}
+
+func (run *stagingRun) cleanup() {
+	for _, release := range run.releases {
+		release()
+	}
+	for _, table := range run.tables {
+		_, err := run.pg.conn.Exec(context.Background(), `DROP TABLE IF EXISTS `+table)
+		if err != nil {
+			run.pg.Logger.Printf("Cannot drop staging table %s: %s", table, err)
+		}
+	}
+	run.connLock.Lock()
+	defer run.connLock.Unlock()
+	_ = run.conn.Close(context.Background())
+}
+
+func (run *stagingRun) cleanupWhenDrained(channels []<-chan types.Record) []<-chan types.Record {
+	var wg sync.WaitGroup
+	forwarded := make([]<-chan types.Record, len(channels))
+	for i, channel := range channels {
+		out := make(chan types.Record)
+		forwarded[i] = out
+		wg.Add(1)
+		go func(in <-chan types.Record) {
+			defer wg.Done()
+			defer close(out)
+			for record := range in {
+				out <- record
+			}
+		}(channel)
+	}
+	go func() {
+		wg.Wait()
+		run.cleanup()
+	}()
+	return forwarded
+}
+
+func (pg *Subscriber) dropStaleStaging() {
+	var statements []string
+
+	rows, err := pg.conn.Query(context.Background(), `SELECT tablename FROM pg_tables WHERE schemaname = $1 AND starts_with(tablename, $2)`, pg.Schema, StagingTablePrefix)
+	if err != nil {
+		pg.Logger.Printf("Cannot list staging tables: %s", err)
+		return
+	}
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		pg.Logger.Printf("Cannot list staging tables: %s", err)
+		return
+	}
+	runs := map[int32][]string{}
+	for _, table := range tables {
+		parts := strings.SplitN(strings.TrimPrefix(table, StagingTablePrefix), "_", 2)
+		id, err := strconv.ParseInt(parts[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		runs[int32(id)] = append(runs[int32(id)], table)
+	}
+
+	conn, err := pg.conn.Acquire(context.Background())
+	if err != nil {
+		pg.Logger.Printf("Cannot check staging runs: %s", err)
+		return
+	}
+	defer conn.Release()
+	for id, tables := range runs {
+		var alive bool
+		err = conn.QueryRow(context.Background(), `SELECT NOT pg_try_advisory_lock(hashtext($1), $2)`, pg.Schema, id).Scan(&alive)
+		if err != nil || alive {
+			continue
+		}
+		for _, table := range tables {
+			statements = append(statements, fmt.Sprintf(`DROP TABLE IF EXISTS "%s"."%s"`, pg.Schema, table))
+		}
+		_, _ = conn.Exec(context.Background(), `SELECT pg_advisory_unlock(hashtext($1), $2)`, pg.Schema, id)
+	}
+
+	views, err := pg.getLegacyViews()
+	if err != nil {
+		pg.Logger.Printf("Cannot list materialized views: %s", err)
+		return
+	}
+	for _, view := range views {
+		statements = append(statements, fmt.Sprintf(`DROP MATERIALIZED VIEW IF EXISTS "%s"."%s" CASCADE`, pg.Schema, view))
+	}
+
+	for _, statement := range statements {
+		_, err = pg.conn.Exec(context.Background(), statement)
+		if err != nil {
+			pg.Logger.Printf("Cannot drop stale staging object: %s", err)
+			continue
+		}
+		pg.Logger.Print(statement)
+	}
+}
+
+// getLegacyViews list materialized views created by previous versions in the legacy schema
+func (pg *Subscriber) getLegacyViews() ([]string, error) {
+	if pg.Schema != LegacySchemaName {
+		return nil, nil
+	}
+	rows, err := pg.conn.Query(context.Background(), `SELECT matviewname FROM pg_matviews WHERE schemaname = $1 AND (starts_with(matviewname, 'pgsync_temp_view_') OR matviewname LIKE '%\_tmp\_view') ORDER BY matviewname`, pg.Schema)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
@@ -0,0 +1,89 @@
+package postgresql
+
+import (
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"reflect"
+	"testing"
+)
+
+func TestGetStagingLevels(t *testing.T) {
+	type relation struct {
+		name   string
+		parent string
+		view   bool
+	}
+	tests := []struct {
+		name      string
+		relations []relation
+		expected  [][]string
+	}{
+		{
+			name:      "no view",
+			relations: []relation{{name: "author"}},
+			expected:  nil,
+		},
+		{
+			name:      "independent views",
+			relations: []relation{{name: "tags", view: true}, {name: "author", view: true}},
+			expected:  [][]string{{"author", "tags"}},
+		},
+		{
+			name: "nested views",
+			relations: []relation{
+				{name: "comments", view: true},
+				{name: "author", parent: "comments", view: true},
+				{name: "avatar", parent: "comments_author", view: true},
+			},
+			expected: [][]string{{"comments_author_avatar"}, {"comments_author"}, {"comments"}},
+		},
+		{
+			name: "relation without view between views",
+			relations: []relation{
+				{name: "comments", view: true},
+				{name: "author", parent: "comments"},
+				{name: "profile", parent: "comments_author", view: true},
+				{name: "tags", view: true},
+			},
+			expected: [][]string{{"comments_author_profile", "tags"}, {"comments"}},
+		},
+		{
+			name: "view depending on leaves of different depths",
+			relations: []relation{
+				{name: "comments", view: true},
+				{name: "likes", parent: "comments", view: true},
+				{name: "author", parent: "comments", view: true},
+				{name: "avatar", parent: "comments_author", view: true},
+			},
+			expected: [][]string{{"comments_author_avatar", "comments_likes"}, {"comments_author"}, {"comments"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			all := map[string]*types.Relation{}
+			views := types.Relations{}
+			for _, r := range test.relations {
+				rel := &types.Relation{Name: r.name, UniqueName: r.name, UsingView: r.view}
+				if r.parent != "" {
+					rel.Parent = all[r.parent]
+					rel.UniqueName = r.parent + "_" + r.name
+				}
+				all[rel.UniqueName] = rel
+				if r.view {
+					views[rel.UniqueName] = rel
+				}
+			}
+
+			var levels [][]string
+			for _, level := range getStagingLevels(views) {
+				var names []string
+				for _, view := range level {
+					names = append(names, view.UniqueName)
+				}
+				levels = append(levels, names)
+			}
+			if !reflect.DeepEqual(levels, test.expected) {
+				t.Errorf("got %v, expected %v", levels, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"strings"
+)
+
+const DependentObjectsStillExist = "2BP01"
+
+func (pg *Subscriber) Teardown(indices []*types.Index, dryRun bool) error {
+	statements, err := pg.getTeardownStatements(indices)
+	if err != nil {
+		return err
+	}
+	return pg.execTeardownStatements(statements, dryRun)
+}
+
+func (pg *Subscriber) getTeardownStatements(indices []*types.Index) ([]string, error) {
+	var statements []string
+	seen := map[string]bool{}
+	add := func(statement string) {
+		if !seen[statement] {
+			seen[statement] = true
+			statements = append(statements, statement)
+		}
+	}
+
+	var triggers []*trigger
+	for _, level := range []string{TriggerLevelRow, TriggerLevelStatement} {
+		triggers = append(triggers, pg.getLevelTriggers(indices, level)...)
+	}
+	for _, t := range triggers {
+		add(fmt.Sprintf(`DROP TRIGGER IF EXISTS "%s" ON %s`, t.Name, t.Table))
+		for _, statement := range t.getDropObsoleteSql() {
+			add(statement)
+		}
+	}
+	for _, t := range triggers {
+		add(fmt.Sprintf(`DROP FUNCTION IF EXISTS "%s"."%s"()`, pg.Schema, t.Function))
+	}
+	// Functions of previous versions were named after the table
+	for _, index := range indices {
+		add(fmt.Sprintf(`DROP FUNCTION IF EXISTS "%s"."%s"()`, pg.Schema, getIdentifier(NotifyTriggerFunctionPrefix+"_"+index.Table)))
+	}
+
+	for _, table := range []string{OutboxTableName, OverflowTableName, CheckpointTableName} {
+		add(fmt.Sprintf(`DROP TABLE IF EXISTS "%s"."%s"`, pg.Schema, table))
+	}
+	rows, err := pg.conn.Query(context.Background(), `SELECT tablename FROM pg_tables WHERE schemaname = $1 AND starts_with(tablename, $2) ORDER BY tablename`, pg.Schema, StagingTablePrefix)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		add(fmt.Sprintf(`DROP TABLE IF EXISTS "%s"."%s"`, pg.Schema, table))
+	}
+	views, err := pg.getLegacyViews()
+	if err != nil {
+		return nil, err
+	}
+	for _, view := range views {
+		add(fmt.Sprintf(`DROP MATERIALIZED VIEW IF EXISTS "%s"."%s" CASCADE`, pg.Schema, view))
+	}
+
+	add(fmt.Sprintf(`DROP SCHEMA IF EXISTS "%s" RESTRICT`, pg.Schema))
+	return statements, nil
+}
+
+func (pg *Subscriber) execTeardownStatements(statements []string, dryRun bool) error {
+	for _, statement := range statements {
+		if dryRun {
+			fmt.Println(statement + ";")
+			continue
+		}
+		_, err := pg.conn.Exec(context.Background(), statement)
+		var pgErr *pgconn.PgError
+		if strings.HasPrefix(statement, "DROP SCHEMA") && errors.As(err, &pgErr) && pgErr.Code == DependentObjectsStillExist {
+			pg.Logger.Printf("Schema %s still contains other objects, kept", pg.Schema)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+		pg.Logger.Print(statement)
+	}
+	return nil
+}
+
+func (pg *ReplicationSubscriber) Teardown(indices []*types.Index, dryRun bool) error {
+	statements, err := pg.getTeardownStatements(indices)
+	if err != nil {
+		return err
+	}
+	err = pg.execTeardownStatements(statements, dryRun)
+	if err != nil {
+		return err
+	}
+
+	var slotExists bool
+	err = pg.conn.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, pg.Slot).Scan(&slotExists)
+	if err != nil {
+		return err
+	}
+	if slotExists {
+		if dryRun {
+			fmt.Printf("SELECT pg_drop_replication_slot(%s);\n", quoteLiteral(pg.Slot))
+		} else {
+			_, err = pg.conn.Exec(context.Background(), `SELECT pg_drop_replication_slot($1)`, pg.Slot)
+			if err != nil {
+				return fmt.Errorf("drop replication slot %s: %w", pg.Slot, err)
+			}
+			pg.Logger.Printf("Replication slot %s dropped", pg.Slot)
+		}
+	}
+
+	var comment *string
+	err = pg.conn.QueryRow(context.Background(), `SELECT obj_description(oid, 'pg_publication') FROM pg_publication WHERE pubname = $1`, pg.Publication).Scan(&comment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if comment == nil || *comment != PublicationComment {
+		pg.Logger.Printf("Publication %s was not created by pg-el-sync, kept", pg.Publication)
+		return nil
+	}
+	return pg.execTeardownStatements([]string{fmt.Sprintf(`DROP PUBLICATION IF EXISTS "%s"`, pg.Publication)}, dryRun)
+}
@@ -0,0 +1,113 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/quix-labs/pg-el-sync/internals/utils"
+	"sync"
+	"time"
+)
+
+// Throttle slow down full reindex queries to protect the database
+type Throttle struct {
+	StatementTimeout  time.Duration // Applied to each staging and page query, 0 to keep the connection value
+	MaxActiveQueries  int           // Pause while more client queries are active, 0 to disable
+	MaxReplicationLag time.Duration // Pause while a standby replays later than this, 0 to disable
+	CheckInterval     time.Duration
+
+	lock      sync.Mutex
+	checking  bool // A caller is querying the load
+	checkedAt time.Time
+	busy      bool
+}
+
+func (pg *Subscriber) initThrottle(config map[string]any) {
+	pg.Throttle.CheckInterval = DefaultThrottleCheckInterval
+	var throttleConfig map[string]any
+	if utils.ParseMapKey(config, "throttle", &throttleConfig) != nil || throttleConfig == nil {
+		return
+	}
+	_ = utils.ParseMapKey(throttleConfig, "max_active_queries", &pg.Throttle.MaxActiveQueries)
+	durations := map[string]*time.Duration{
+		"statement_timeout":   &pg.Throttle.StatementTimeout,
+		"max_replication_lag": &pg.Throttle.MaxReplicationLag,
+		"check_interval":      &pg.Throttle.CheckInterval,
+	}
+	for key, duration := range durations {
+		var raw string
+		if utils.ParseMapKey(throttleConfig, key, &raw) != nil {
+			continue
+		}
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			pg.Logger.Fatal().Err(err).Msgf("Invalid throttle %s %s", key, raw)
+		}
+		*duration = parsed
+	}
+}
+
+func (pg *Subscriber) setStatementTimeout(tx pgx.Tx) error {
+	if pg.Throttle.StatementTimeout <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(context.Background(), fmt.Sprintf(`SET LOCAL statement_timeout = %d`, pg.Throttle.StatementTimeout.Milliseconds()))
+	return err
+}
+
+func (pg *Subscriber) waitForLoad() {
+	if pg.Throttle.MaxActiveQueries <= 0 && pg.Throttle.MaxReplicationLag <= 0 {
+		return
+	}
+	for pg.isBusy() {
+		time.Sleep(pg.Throttle.CheckInterval)
+	}
+}
+
+func (pg *Subscriber) isBusy() bool {
+	pg.Throttle.lock.Lock()
+	if pg.Throttle.checking || time.Since(pg.Throttle.checkedAt) < pg.Throttle.CheckInterval {
+		busy := pg.Throttle.busy
+		pg.Throttle.lock.Unlock()
+		return busy
+	}
+	pg.Throttle.checking = true
+	pg.Throttle.lock.Unlock()
+
+	busy := pg.checkLoad()
+
+	pg.Throttle.lock.Lock()
+	defer pg.Throttle.lock.Unlock()
+	pg.Throttle.checking = false
+	pg.Throttle.checkedAt = time.Now()
+	pg.Throttle.busy = busy
+	return busy
+}
+
+func (pg *Subscriber) checkLoad() bool {
+	if pg.Throttle.MaxActiveQueries > 0 {
+		var active int
+		err := pg.conn.QueryRow(context.Background(),
+			`SELECT count(*) FROM pg_stat_activity WHERE state = 'active' AND backend_type = 'client backend' AND pid <> pg_backend_pid()`,
+		).Scan(&active)
+		if err != nil {
+			pg.Logger.Printf("Cannot check active queries: %s", err)
+		} else if active > pg.Throttle.MaxActiveQueries {
+			pg.Logger.Printf("Reindex paused: %d active queries", active)
+			return true
+		}
+	}
+	if pg.Throttle.MaxReplicationLag > 0 {
+		var lag float64
+		err := pg.conn.QueryRow(context.Background(),
+			`SELECT COALESCE(EXTRACT(EPOCH FROM max(replay_lag)), 0)::FLOAT8 FROM pg_stat_replication`,
+		).Scan(&lag)
+		if err != nil {
+			pg.Logger.Printf("Cannot check replication lag: %s", err)
+		} else if lagDuration := time.Duration(lag * float64(time.Second)); lagDuration > pg.Throttle.MaxReplicationLag {
+			pg.Logger.Printf("Reindex paused: replication lag %s", lagDuration.String())
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,494 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/quix-labs/pg-el-sync/internals/types"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type trigger struct {
+	Name       string
+	Table      string // Quoted, schema qualified when defined
+	Function   string
+	Body       string // plpgsql source of the function
+	Events     string
+	Columns    []string // UPDATE OF columns of row level triggers, nil for every column
+	Level      string   // ROW or STATEMENT
+	Transition transition
+	Obsolete   []string
+}
+
+type transition struct {
+	Old string
+	New string
+}
+
+// MaxIdentifierLength is the length PostgreSQL truncates identifiers to
+const MaxIdentifierLength = 63
+
+// rowEvents is used by row level triggers, statement level triggers have one trigger per event
+const rowEvents = "DELETE OR UPDATE OR INSERT"
+
+var statementEvents = []string{"INSERT", "UPDATE", "DELETE"}
+
+func (t *trigger) getFunctionSql(schema string) string {
+	return fmt.Sprintf(
+		`CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$%s$trigger$ LANGUAGE plpgsql VOLATILE`,
+		schema,
+		t.Function,
+		t.Body,
+	)
+}
+
+func (t *trigger) getTriggerSql(schema string) string {
+	referencing := ""
+	if t.Transition.Old != "" {
+		referencing += fmt.Sprintf(`OLD TABLE AS "%s" `, t.Transition.Old)
+	}
+	if t.Transition.New != "" {
+		referencing += fmt.Sprintf(`NEW TABLE AS "%s" `, t.Transition.New)
+	}
+	if referencing != "" {
+		referencing = "REFERENCING " + referencing
+	}
+	return fmt.Sprintf(
+		`CREATE OR REPLACE TRIGGER "%s" AFTER %s ON %s %sFOR EACH %s EXECUTE PROCEDURE "%s"."%s"()`,
+		t.Name,
+		t.Events,
+		t.Table,
+		referencing,
+		t.Level,
+		schema,
+		t.Function,
+	)
+}
+
+// getType return the expected pg_trigger.tgtype
+func (t *trigger) getType() int16 {
+	var triggerType int16
+	if t.Level == "ROW" {
+		triggerType |= 1 << 0
+	}
+	events := statementEvents // Row level triggers fire on every event
+	if t.Level == "STATEMENT" {
+		events = []string{t.Events}
+	}
+	for _, event := range events {
+		switch event {
+		case "INSERT":
+			triggerType |= 1 << 2
+		case "DELETE":
+			triggerType |= 1 << 3
+		case "UPDATE":
+			triggerType |= 1 << 4
+		}
+	}
+	return triggerType
+}
+
+func (t *trigger) getDropObsoleteSql() []string {
+	var statements []string
+	for _, name := range t.Obsolete {
+		statements = append(statements, fmt.Sprintf(`DROP TRIGGER IF EXISTS "%s" ON %s`, name, t.Table))
+	}
+	return statements
+}
+
+func (t *trigger) getInstallSql(schema string) []string {
+	statements := []string{t.getFunctionSql(schema)}
+	statements = append(statements, t.getDropObsoleteSql()...)
+	return append(statements, t.getTriggerSql(schema))
+}
+
+func (t *trigger) withRowLevel(columns []string) *trigger {
+	t.Events, t.Columns, t.Level = getRowEvents(columns), columns, "ROW"
+	for _, event := range statementEvents {
+		t.Obsolete = append(t.Obsolete, t.Name+"_"+strings.ToLower(event))
+	}
+	return t
+}
+
+func (pg *Subscriber) getTriggers(indices []*types.Index) []*trigger {
+	return pg.getLevelTriggers(indices, pg.TriggerLevel)
+}
+
+func (pg *Subscriber) getLevelTriggers(indices []*types.Index, level string) []*trigger {
+	var triggers []*trigger
+	for _, index := range indices {
+		var indexTriggers []*trigger
+		if level == TriggerLevelStatement {
+			indexTriggers = pg.getIndexStatementTriggers(index)
+		} else {
+			indexTriggers = []*trigger{pg.getIndexTrigger(index)}
+		}
+		for _, t := range indexTriggers {
+			t.Obsolete = append(t.Obsolete, pg.getLegacyIndexTriggerNames(index)...)
+		}
+		triggers = append(triggers, indexTriggers...)
+		for _, relation := range index.GetAllRelations() {
+			if level == TriggerLevelStatement {
+				triggers = append(triggers, pg.getRelationStatementTriggers(relation, index)...)
+			} else {
+				triggers = append(triggers, pg.getRelationTrigger(relation, index))
+			}
+			if relation.Type == "many_to_many" {
+				if level == TriggerLevelStatement {
+					triggers = append(triggers, pg.getPivotRelationStatementTriggers(relation, index)...)
+				} else {
+					triggers = append(triggers, pg.getPivotRelationTrigger(relation, index))
+				}
+			}
+		}
+	}
+
+	// Names are quoted, triggers installed unquoted by previous versions were lower cased and truncated
+	for _, t := range triggers {
+		names := append([]string{t.Name}, t.Obsolete...)
+		t.Name, t.Function = getIdentifier(t.Name), getIdentifier(t.Function)
+		t.Obsolete = nil
+		for _, name := range names {
+			t.Obsolete = append(t.Obsolete, getIdentifier(name), getLegacyIdentifier(name))
+		}
+	}
+
+	// Never drop a trigger installed for another mapping of the same table
+	installed := map[string]bool{}
+	for _, t := range triggers {
+		installed[t.Table+"."+t.Name] = true
+	}
+	for _, t := range triggers {
+		var obsolete []string
+		seen := map[string]bool{}
+		for _, name := range t.Obsolete {
+			if !installed[t.Table+"."+name] && !seen[name] {
+				obsolete = append(obsolete, name)
+				seen[name] = true
+			}
+		}
+		t.Obsolete = obsolete
+	}
+	return triggers
+}
+
+// getIdentifier shorten names too long and suffix them by a hash of the full name
+func getIdentifier(name string) string {
+	if len(name) <= MaxIdentifierLength {
+		return name
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+	suffix := fmt.Sprintf("_%08x", hash.Sum32())
+	return truncateIdentifier(name, MaxIdentifierLength-len(suffix)) + suffix
+}
+
+// getLegacyIdentifier return name as stored when unquoted
+func getLegacyIdentifier(name string) string {
+	lowered := []byte(name)
+	for i, c := range lowered {
+		if c >= 'A' && c <= 'Z' {
+			lowered[i] = c + 'a' - 'A'
+		}
+	}
+	return truncateIdentifier(string(lowered), MaxIdentifierLength)
+}
+
+func truncateIdentifier(name string, length int) string {
+	if len(name) <= length {
+		return name
+	}
+	for length > 0 && !utf8.RuneStart(name[length]) {
+		length--
+	}
+	return name[:length]
+}
+
+func (pg *Subscriber) getIndexTriggerName(index *types.Index) string {
+	return pg.Schema + "_" + index.Name + "_trigger"
+}
+
+func (pg *Subscriber) getLegacyIndexTriggerNames(index *types.Index) []string {
+	name := pg.Schema + index.Table + "_trigger"
+	names := []string{name}
+	for _, event := range statementEvents {
+		names = append(names, name+"_"+strings.ToLower(event))
+	}
+	return names
+}
+
+func (pg *Subscriber) getRelationTriggerName(relation *types.Relation, index *types.Index) string {
+	return pg.Schema + "_rel_" + index.Name + "_" + relation.UniqueName
+}
+
+func (pg *Subscriber) getPivotRelationTriggerName(relation *types.Relation, index *types.Index) string {
+	return pg.Schema + "_rel_pivot_" + index.Name + "_" + relation.UniqueName
+}
+
+func (pg *Subscriber) getIndexFunctionName(index *types.Index) string {
+	return NotifyTriggerFunctionPrefix + "_" + index.Name
+}
+
+func (pg *Subscriber) getIndexTrigger(index *types.Index) *trigger {
+	whereOkSql, oldWhereOkSql := "true", "true"
+	if len(index.Wheres) > 0 {
+		wheres := Wheres(index.Wheres)
+		whereOkSql = "(" + wheres.GetConditionSql("NEW", true) + ")"
+		oldWhereOkSql = "(" + wheres.GetConditionSql("OLD", true) + ")"
+	}
+	idx := Index(*index)
+	payload := fmt.Sprintf(`json_build_object(
+		'type', 'table',
+		'index', '%s',
+        'action', LOWER(TG_OP),
+        'reference',(CASE WHEN TG_OP = 'DELETE' THEN %s ELSE %s END)::TEXT,
+        'old_reference',%s::TEXT,
+        'soft_deleted',NOT (%s),
+        'old_soft_deleted',NOT (%s)
+    )`, index.Name, idx.getReferenceSql("OLD", true), idx.getReferenceSql("NEW", true), idx.getReferenceSql("OLD", true), whereOkSql, oldWhereOkSql)
+	columns := getIndexColumns(index)
+	return (&trigger{
+		Name:     pg.getIndexTriggerName(index),
+		Table:    quoteTable(index.Schema, index.Table),
+		Function: pg.getIndexFunctionName(index),
+		Body: fmt.Sprintf(`
+BEGIN
+  IF TG_OP <> 'UPDATE' OR %s THEN
+    %s
+  END IF;
+  RETURN COALESCE(NEW, OLD);
+END;
+`, getColumnsChangedSql("NEW", "OLD", columns), pg.getEmitSql(payload)),
+	}).withRowLevel(columns)
+}
+
+func (pg *Subscriber) getRelationTrigger(relation *types.Relation, index *types.Index) *trigger {
+	payload := fmt.Sprintf(`json_build_object(
+		'type', 'relation',
+        'index', '%s',
+        'relation','%s',
+        'reference',COALESCE(NEW."%s", OLD."%s")::TEXT
+    )`, index.Name, relation.UniqueName, relation.ForeignKey.Local, relation.ForeignKey.Local)
+	columns := getRelationColumns(relation)
+	// Notify rows entering, leaving or matching the filter, changes of rows filtered before and after do not alter documents
+	activeSql := "true"
+	if rel := Relation(*relation); rel.hasFilter() {
+		activeSql = fmt.Sprintf(`(COALESCE(%s, false) OR COALESCE(%s, false))`, rel.getFilterSql("NEW", true), rel.getFilterSql("OLD", true))
+	}
+	return (&trigger{
+		Name:     pg.getRelationTriggerName(relation, index),
+		Table:    quoteTable(relation.Schema, relation.Table),
+		Function: NotifyTriggerFunctionPrefix + "_" + index.Name + "_rel_" + relation.UniqueName,
+		Body: fmt.Sprintf(`
+BEGIN
+  IF (TG_OP <> 'UPDATE' OR %s) AND COALESCE(NEW."%s",OLD."%s") IS NOT NULL AND %s THEN
+    %s
+  END IF;
+  RETURN COALESCE(NEW, OLD);
+END;
+`, getColumnsChangedSql("NEW", "OLD", columns), relation.ForeignKey.Local, relation.ForeignKey.Local, activeSql, pg.getEmitSql(payload)),
+	}).withRowLevel(columns)
+}
+
+func (pg *Subscriber) getPivotRelationTrigger(relation *types.Relation, index *types.Index) *trigger {
+	payload := fmt.Sprintf(`json_build_object(
+		'type', 'relation_pivot',
+        'index', '%s',
+        'relation','%s',
+        'local',COALESCE(NEW."%s", null)::TEXT,
+        'old_local',COALESCE(OLD."%s", null)::TEXT,
+        'related',COALESCE(NEW."%s", null)::TEXT,
+        'old_related',COALESCE(OLD."%s", null)::TEXT
+    )`, index.Name, relation.UniqueName, relation.ForeignKey.PivotLocal, relation.ForeignKey.PivotLocal, relation.ForeignKey.PivotRelated, relation.ForeignKey.PivotRelated)
+	columns := getPivotColumns(relation)
+	return (&trigger{
+		Name:     pg.getPivotRelationTriggerName(relation, index),
+		Table:    quoteTable(relation.ForeignKey.PivotSchema, relation.ForeignKey.PivotTable),
+		Function: NotifyTriggerFunctionPrefix + "_" + index.Name + "_rel_pivot_" + relation.UniqueName,
+		Body: fmt.Sprintf(`
+BEGIN
+  IF TG_OP <> 'UPDATE' OR %s THEN
+    %s
+  END IF;
+  RETURN COALESCE(NEW, OLD);
+END;
+`, getColumnsChangedSql("NEW", "OLD", columns), pg.getEmitSql(payload)),
+	}).withRowLevel(columns)
+}
+
+// ----------------------------------------STATEMENT LEVEL TRIGGERS------------------------------------------
+
+var statementTransitions = map[string]transition{
+	"INSERT": {New: "pgsync_new"},
+	"UPDATE": {Old: "pgsync_old", New: "pgsync_new"},
+	"DELETE": {Old: "pgsync_old"},
+}
+
+// getStatementTriggers build one trigger per event, transition rows are aliased new_row and old_row
+func (pg *Subscriber) getStatementTriggers(name string, table string, function string, batchPayload string, sources func(event string) (string, string)) []*trigger {
+	var triggers []*trigger
+	for _, event := range statementEvents {
+		rowSql, fromSql := sources(event)
+		payload := fmt.Sprintf(batchPayload, "batch")
+		triggers = append(triggers, &trigger{
+			Name:     name + "_" + strings.ToLower(event),
+			Table:    table,
+			Function: function + "_" + strings.ToLower(event),
+			Body: fmt.Sprintf(`
+DECLARE
+  batch JSON;
+BEGIN
+  FOR batch IN
+    SELECT json_agg("rows"."row") FROM (
+      SELECT "sized"."row", (sum("sized"."size") OVER (ROWS UNBOUNDED PRECEDING) - "sized"."size") / %d AS "chunk"
+      FROM (SELECT "source"."row", octet_length("source"."row"::TEXT) AS "size" FROM (SELECT %s AS "row"
+      %s) AS "source") AS "sized"
+    ) AS "rows" GROUP BY "rows"."chunk"
+  LOOP
+    %s
+  END LOOP;
+  RETURN NULL;
+END;
+`, StatementBatchBytes, rowSql, fromSql, pg.getEmitSql(payload)),
+			Events:     event,
+			Level:      "STATEMENT",
+			Transition: statementTransitions[event],
+			Obsolete:   []string{name},
+		})
+	}
+	return triggers
+}
+
+func (pg *Subscriber) getIndexStatementTriggers(index *types.Index) []*trigger {
+	whereOkSql, oldWhereOkSql := "true", "true"
+	if len(index.Wheres) > 0 {
+		wheres := Wheres(index.Wheres)
+		whereOkSql = "(" + wheres.GetConditionSql("new_row", true) + ")"
+		oldWhereOkSql = "(" + wheres.GetConditionSql("old_row", true) + ")"
+	}
+	idx := Index(*index)
+	newReference, oldReference := idx.getReferenceSql("new_row", true), idx.getReferenceSql("old_row", true)
+	batchPayload := fmt.Sprintf(`json_build_object('type', 'table_batch', 'index', '%s', 'rows', %%s)`, index.Name)
+
+	return pg.getStatementTriggers(pg.getIndexTriggerName(index), quoteTable(index.Schema, index.Table), pg.getIndexFunctionName(index), batchPayload, func(event string) (string, string) {
+		switch event {
+		case "INSERT":
+			return fmt.Sprintf(`json_build_object('action', 'insert', 'reference', %s::TEXT)`, newReference),
+				`FROM "pgsync_new" AS new_row`
+		case "DELETE":
+			return fmt.Sprintf(`json_build_object('action', 'delete', 'reference', %s::TEXT)`, oldReference),
+				`FROM "pgsync_old" AS old_row`
+		}
+		// Rows are paired by reference, a row whose reference changed is seen as deleted then inserted
+		firstField := index.ReferenceFields[0]
+		return fmt.Sprintf(`json_build_object(
+        'action', CASE WHEN new_row."%s" IS NULL THEN 'delete' WHEN old_row."%s" IS NULL THEN 'insert' ELSE 'update' END,
+        'reference', COALESCE(%s, %s)::TEXT,
+        'old_reference', %s::TEXT,
+        'soft_deleted', NOT %s,
+        'old_soft_deleted', NOT %s
+      )`, firstField, firstField, newReference, oldReference, oldReference, whereOkSql, oldWhereOkSql),
+			fmt.Sprintf(`FROM "pgsync_new" AS new_row FULL JOIN "pgsync_old" AS old_row ON %s = %s
+      WHERE %s`, oldReference, newReference, getColumnsChangedSql("new_row", "old_row", getIndexColumns(index)))
+	})
+}
+
+func (pg *Subscriber) getRelationStatementTriggers(relation *types.Relation, index *types.Index) []*trigger {
+	batchPayload := fmt.Sprintf(`json_build_object('type', 'relation_batch', 'index', '%s', 'relation', '%s', 'references', %%s)`, index.Name, relation.UniqueName)
+	function := NotifyTriggerFunctionPrefix + "_" + index.Name + "_rel_" + relation.UniqueName
+	rel := Relation(*relation)
+	return pg.getStatementTriggers(pg.getRelationTriggerName(relation, index), quoteTable(relation.Schema, relation.Table), function, batchPayload, func(event string) (string, string) {
+		return `"references"."reference"`, getStatementReferencesFromSql(event, quoteTable(relation.Schema, relation.Table), relation.ForeignKey.Local, getRelationColumns(relation), rel.getFilterWheres())
+	})
+}
+
+func (pg *Subscriber) getPivotRelationStatementTriggers(relation *types.Relation, index *types.Index) []*trigger {
+	batchPayload := fmt.Sprintf(`json_build_object('type', 'relation_batch', 'index', '%s', 'relation', '%s', 'pivot', true, 'references', %%s)`, index.Name, relation.UniqueName)
+	function := NotifyTriggerFunctionPrefix + "_" + index.Name + "_rel_pivot_" + relation.UniqueName
+	return pg.getStatementTriggers(pg.getPivotRelationTriggerName(relation, index), quoteTable(relation.ForeignKey.PivotSchema, relation.ForeignKey.PivotTable), function, batchPayload, func(event string) (string, string) {
+		return `"references"."reference"`, getStatementReferencesFromSql(event, quoteTable(relation.ForeignKey.PivotSchema, relation.ForeignKey.PivotTable), relation.ForeignKey.PivotLocal, getPivotColumns(relation), nil)
+	})
+}
+
+// getStatementReferencesFromSql select references of rows changed in the transition tables of event,
+// updated rows are compared as jsonb as some column types have no equality operator
+func getStatementReferencesFromSql(event string, table string, column string, columns []string, filter Wheres) string {
+	activeSql := func(table string) string {
+		if len(filter) == 0 {
+			return ""
+		}
+		return " WHERE " + filter.GetConditionSql(table, false)
+	}
+	var selects []string
+	switch event {
+	case "INSERT":
+		selects = append(selects, fmt.Sprintf(`SELECT DISTINCT "new_row"."%s"::TEXT AS "reference" FROM "pgsync_new" AS "new_row"%s`, column, activeSql("new_row")))
+	case "DELETE":
+		selects = append(selects, fmt.Sprintf(`SELECT DISTINCT "old_row"."%s"::TEXT AS "reference" FROM "pgsync_old" AS "old_row"%s`, column, activeSql("old_row")))
+	default:
+		value := `to_jsonb("row")`
+		if columns != nil {
+			quoted := make([]string, len(columns))
+			for i, col := range columns {
+				quoted[i] = `"row"."` + col + `"`
+			}
+			value = `(SELECT to_jsonb("projected") FROM (SELECT ` + strings.Join(quoted, ", ") + `) AS "projected")`
+		}
+		for _, tables := range [][2]string{{"pgsync_new", "pgsync_old"}, {"pgsync_old", "pgsync_new"}} {
+			selects = append(selects, fmt.Sprintf(
+				`SELECT "changed"."%s"::TEXT AS "reference" FROM (SELECT %s AS "value" FROM "%s" AS "row" EXCEPT SELECT %s FROM "%s" AS "row") AS "values", jsonb_populate_record(NULL::%s, "values"."value") AS "changed"%s`,
+				column, value, tables[0], value, tables[1], table, activeSql("changed"),
+			))
+		}
+	}
+	return fmt.Sprintf(`FROM (%s) AS "references" WHERE "references"."reference" IS NOT NULL`, strings.Join(selects, " UNION "))
+}
+
+func (pg *Subscriber) verifyTriggers(triggers []*trigger) error {
+	var errs []error
+	for _, t := range triggers {
+		var source string
+		err := pg.conn.QueryRow(
+			context.Background(),
+			`SELECT p.prosrc FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace WHERE n.nspname = $1 AND p.proname = $2`,
+			pg.Schema, t.Function,
+		).Scan(&source)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(`function "%s"."%s" not found: %w`, pg.Schema, t.Function, err))
+		} else if strings.TrimSpace(source) != strings.TrimSpace(t.Body) {
+			errs = append(errs, fmt.Errorf(`function "%s"."%s" does not match the configuration`, pg.Schema, t.Function))
+		}
+
+		var functionSchema, function, definition string
+		var triggerType int16
+		var oldTable, newTable string
+		var columns []string
+		err = pg.conn.QueryRow(
+			context.Background(),
+			`SELECT n.nspname, p.proname, t.tgtype, COALESCE(t.tgoldtable::TEXT, ''), COALESCE(t.tgnewtable::TEXT, ''),
+			ARRAY(SELECT a.attname::TEXT FROM unnest(t.tgattr) AS c(attnum) JOIN pg_attribute a ON a.attrelid = t.tgrelid AND a.attnum = c.attnum),
+			pg_get_triggerdef(t.oid)
+			FROM pg_trigger t JOIN pg_proc p ON p.oid = t.tgfoid JOIN pg_namespace n ON n.oid = p.pronamespace
+			WHERE t.tgname = $1 AND t.tgrelid = $2::regclass AND NOT t.tgisinternal`,
+			t.Name, t.Table,
+		).Scan(&functionSchema, &function, &triggerType, &oldTable, &newTable, &columns, &definition)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(`trigger "%s" on %s not found: %w`, t.Name, t.Table, err))
+			continue
+		}
+		if functionSchema != pg.Schema || function != t.Function {
+			errs = append(errs, fmt.Errorf(`trigger "%s" on %s execute "%s"."%s" instead of "%s"."%s"`, t.Name, t.Table, functionSchema, function, pg.Schema, t.Function))
+		}
+		sort.Strings(columns)
+		if triggerType != t.getType() || oldTable != t.Transition.Old || newTable != t.Transition.New || strings.Join(columns, ",") != strings.Join(t.Columns, ",") {
+			errs = append(errs, fmt.Errorf(`trigger "%s" on %s does not match the configuration, installed as: %s, expected: %s`, t.Name, t.Table, definition, t.getTriggerSql(pg.Schema)))
+		}
+	}
+	for _, err := range errs {
+		pg.Logger.Print(err)
+	}
+	return errors.Join(errs...)
+}
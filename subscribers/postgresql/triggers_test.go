@@ -0,0 +1,59 @@
+package postgresql
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestGetIdentifier(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "short name", input: "pgsync_posts_trigger", expected: "pgsync_posts_trigger"},
+		{name: "maximum length", input: strings.Repeat("a", 63), expected: strings.Repeat("a", 63)},
+		{name: "long name", input: long, expected: strings.Repeat("a", 54) + "_" + hashSuffix(long)},
+		{name: "multibyte character at the limit", input: strings.Repeat("a", 53) + "éé" + long, expected: strings.Repeat("a", 53) + "_" + hashSuffix(strings.Repeat("a", 53)+"éé"+long)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identifier := getIdentifier(test.input)
+			if identifier != test.expected {
+				t.Errorf("got %s, expected %s", identifier, test.expected)
+			}
+			if len(identifier) > MaxIdentifierLength || !utf8.ValidString(identifier) {
+				t.Errorf("invalid identifier %s", identifier)
+			}
+		})
+	}
+
+	if getIdentifier(long+"_insert") == getIdentifier(long+"_update") {
+		t.Error("names sharing a long prefix must not collide")
+	}
+}
+
+func TestGetLegacyIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"pgsync_Posts_trigger":                  "pgsync_posts_trigger",
+		"Événements":                            "Événements",
+		strings.Repeat("A", 70):                 strings.Repeat("a", 63),
+		strings.Repeat("a", 62) + "éa":          strings.Repeat("a", 62),
+		strings.Repeat("a", 61) + "é" + "trail": strings.Repeat("a", 61) + "é",
+	}
+	for input, expected := range tests {
+		if identifier := getLegacyIdentifier(input); identifier != expected {
+			t.Errorf("getLegacyIdentifier(%s) = %s, expected %s", input, identifier, expected)
+		}
+	}
+}
+
+func hashSuffix(name string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+	return fmt.Sprintf("%08x", hash.Sum32())
+}